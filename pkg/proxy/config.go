@@ -4,6 +4,7 @@
 package proxy
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/c4pt0r/cfg"
@@ -15,6 +16,7 @@ type Config struct {
 	productName   string
 	zkAddr        string
 	passwd        string
+	authUser      string
 	fact          ZkFactory
 	proto         string //tcp or tcp4
 	provider      string
@@ -25,6 +27,40 @@ type Config struct {
 	maxBufSize       int
 	maxPipeline      int
 	zkSessionTimeout int
+
+	retryFailLimit int
+	retryMinDelay  int // milliseconds
+	retryMaxDelay  int // milliseconds
+	retryJitter    float64
+
+	retryMaxAttempts int
+
+	slowlogThreshold int // milliseconds
+
+	breakerFailRatio   float64
+	breakerMinRequests int
+	breakerCooldown    int // milliseconds
+
+	warmupCommands []string
+
+	sourceAddr string
+
+	socketLinger int // seconds
+	socketReset  int
+	tcpNoDelay   int
+
+	blockedCommands []string
+
+	maxInflight int
+
+	idleTimeout int // seconds
+
+	flushMaxBuffered int
+	flushMaxInterval int // microseconds
+
+	decoderBufsize int
+
+	maxQPS int
 }
 
 func LoadConf(configFile string) (*Config, error) {
@@ -48,6 +84,7 @@ func LoadConf(configFile string) (*Config, error) {
 	}
 	conf.zkAddr = strings.TrimSpace(conf.zkAddr)
 	conf.passwd, _ = c.ReadString("password", "")
+	conf.authUser, _ = c.ReadString("backend_auth_user", "")
 
 	conf.proxyId, _ = c.ReadString("proxy_id", "")
 	if len(conf.proxyId) == 0 {
@@ -69,6 +106,61 @@ func LoadConf(configFile string) (*Config, error) {
 	conf.maxTimeout = loadConfInt("session_max_timeout", 1800)
 	conf.maxBufSize = loadConfInt("session_max_bufsize", 131072)
 	conf.maxPipeline = loadConfInt("session_max_pipeline", 1024)
+	conf.retryFailLimit = loadConfInt("backend_retry_fail_limit", 10)
+	conf.retryMinDelay = loadConfInt("backend_retry_min_delay", 50)
+	conf.retryMaxDelay = loadConfInt("backend_retry_max_delay", 5000)
+	if conf.retryMinDelay > conf.retryMaxDelay {
+		log.Panicf("invalid config: backend_retry_min_delay = %d > backend_retry_max_delay = %d",
+			conf.retryMinDelay, conf.retryMaxDelay)
+	}
+	if s, _ := c.ReadString("backend_retry_jitter", "0"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || v > 1 {
+			log.Panicf("invalid config: read backend_retry_jitter = %s", s)
+		}
+		conf.retryJitter = v
+	}
+	conf.retryMaxAttempts = loadConfInt("backend_retry_max_attempts", 0)
+	conf.slowlogThreshold = loadConfInt("backend_slowlog_threshold", 0)
+	if s, _ := c.ReadString("backend_breaker_fail_ratio", "0"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || v > 1 {
+			log.Panicf("invalid config: read backend_breaker_fail_ratio = %s", s)
+		}
+		conf.breakerFailRatio = v
+	}
+	conf.breakerMinRequests = loadConfInt("backend_breaker_min_requests", 20)
+	conf.breakerCooldown = loadConfInt("backend_breaker_cooldown", 1000)
+	if s, _ := c.ReadString("backend_warmup_commands", ""); s != "" {
+		for _, cmd := range strings.Split(s, ",") {
+			if cmd = strings.TrimSpace(cmd); cmd != "" {
+				conf.warmupCommands = append(conf.warmupCommands, cmd)
+			}
+		}
+	}
+	conf.sourceAddr, _ = c.ReadString("backend_source_addr", "")
+	// negative is valid, it means the system default
+	conf.socketLinger, _ = c.ReadInt("backend_socket_linger", 0)
+	conf.socketReset = loadConfInt("backend_socket_reset", 0)
+	conf.tcpNoDelay = loadConfInt("backend_tcp_nodelay", 1)
+	conf.sourceAddr = strings.TrimSpace(conf.sourceAddr)
+	if s, _ := c.ReadString("backend_blocked_commands", ""); s != "" {
+		for _, cmd := range strings.Split(s, ",") {
+			if cmd = strings.TrimSpace(cmd); cmd != "" {
+				conf.blockedCommands = append(conf.blockedCommands, cmd)
+			}
+		}
+	}
+	conf.maxInflight = loadConfInt("backend_max_inflight", 4096)
+	conf.idleTimeout = loadConfInt("backend_idle_timeout", 0)
+	conf.flushMaxBuffered = loadConfInt("backend_flush_max_buffered", 64)
+	if conf.flushMaxBuffered > conf.maxInflight && conf.maxInflight != 0 {
+		log.Panicf("invalid config: backend_flush_max_buffered = %d > backend_max_inflight = %d",
+			conf.flushMaxBuffered, conf.maxInflight)
+	}
+	conf.flushMaxInterval = loadConfInt("backend_flush_max_interval", 300)
+	conf.decoderBufsize = loadConfInt("backend_decoder_bufsize", 1024*512)
+	conf.maxQPS = loadConfInt("backend_max_qps", 0)
 	conf.zkSessionTimeout = loadConfInt("zk_session_timeout", 30000)
 	if conf.zkSessionTimeout <= 100 {
 		conf.zkSessionTimeout *= 1000
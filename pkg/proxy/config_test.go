@@ -0,0 +1,33 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestLoadConfSocketLinger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codis")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.ini")
+	ini := "product=test\n" +
+		"dashboard_addr=localhost:18087\n" +
+		"zk=localhost:2181\n" +
+		"proxy_id=proxy_test\n" +
+		"backend_socket_linger=-1\n" +
+		"backend_socket_reset=1\n"
+	assert.MustNoError(ioutil.WriteFile(file, []byte(ini), 0644))
+
+	c, err := LoadConf(file)
+	assert.MustNoError(err)
+	assert.Must(c.socketLinger == -1)
+	assert.Must(c.socketReset == 1)
+}
@@ -74,7 +74,43 @@ func New(addr string, debugVarAddr string, conf *Config) *Server {
 	} else {
 		s.listener = l
 	}
-	s.router = router.NewWithAuth(conf.passwd)
+	s.router = router.NewWithConfig(&router.Config{
+		Auth:     conf.passwd,
+		AuthUser: conf.authUser,
+
+		BackendRetryFailLimit: conf.retryFailLimit,
+		BackendRetryMinDelay:  time.Millisecond * time.Duration(conf.retryMinDelay),
+		BackendRetryMaxDelay:  time.Millisecond * time.Duration(conf.retryMaxDelay),
+		BackendRetryJitter:    conf.retryJitter,
+
+		BackendRetryMaxAttempts: conf.retryMaxAttempts,
+
+		BackendSlowlogThreshold: time.Millisecond * time.Duration(conf.slowlogThreshold),
+
+		BackendBreakerFailRatio:   conf.breakerFailRatio,
+		BackendBreakerMinRequests: conf.breakerMinRequests,
+		BackendBreakerCooldown:    time.Millisecond * time.Duration(conf.breakerCooldown),
+
+		BackendWarmupCommands: conf.warmupCommands,
+
+		BackendSourceAddr: conf.sourceAddr,
+
+		BackendSocketLinger:   conf.socketLinger,
+		BackendSocketReset:    conf.socketReset != 0,
+		BackendDisableNoDelay: conf.tcpNoDelay == 0,
+
+		BackendBlockedCommands: conf.blockedCommands,
+
+		BackendMaxInflight: conf.maxInflight,
+		BackendIdleTimeout: time.Second * time.Duration(conf.idleTimeout),
+
+		BackendFlushMaxBuffered: conf.flushMaxBuffered,
+		BackendFlushMaxInterval: time.Microsecond * time.Duration(conf.flushMaxInterval),
+
+		BackendDecoderBufsize: conf.decoderBufsize,
+
+		BackendMaxQPS: conf.maxQPS,
+	})
 	s.evtbus = make(chan interface{}, 1024)
 
 	s.register()
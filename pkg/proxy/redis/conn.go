@@ -5,6 +5,7 @@ package redis
 
 import (
 	"net"
+	"strings"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/errors"
@@ -21,11 +22,50 @@ type Conn struct {
 }
 
 func DialTimeout(addr string, bufsize int, timeout time.Duration) (*Conn, error) {
-	c, err := net.DialTimeout("tcp", addr, timeout)
+	return DialTimeoutFrom("", addr, bufsize, timeout)
+}
+
+// DialTimeoutFrom is like DialTimeout but binds the local end of the
+// connection to laddr, which is either an ip or an ip:port. An empty
+// laddr lets the system choose.
+//
+// An addr of the form unix:///path/to/redis.sock dials a unix domain
+// socket, laddr is ignored then.
+func DialTimeoutFrom(laddr, addr string, bufsize int, timeout time.Duration) (*Conn, error) {
+	return DialTimeoutSizes(laddr, addr, bufsize, bufsize, timeout)
+}
+
+// DialTimeoutSizes is like DialTimeoutFrom but sizes the read and write
+// buffers separately.
+func DialTimeoutSizes(laddr, addr string, rbufsize, wbufsize int, timeout time.Duration) (*Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	network, addr := SplitNetworkAddr(addr)
+	if laddr != "" && network == "tcp" {
+		if _, _, err := net.SplitHostPort(laddr); err != nil {
+			laddr = net.JoinHostPort(laddr, "0")
+		}
+		a, err := net.ResolveTCPAddr("tcp", laddr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		d.LocalAddr = a
+	}
+	c, err := d.Dial(network, addr)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	return NewConnSize(c, bufsize), nil
+	return NewConnSizes(c, rbufsize, wbufsize), nil
+}
+
+const unixScheme = "unix://"
+
+// SplitNetworkAddr returns the network and the address to dial for a
+// backend address, either host:port or unix:///path/to/redis.sock.
+func SplitNetworkAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", addr[len(unixScheme):]
+	}
+	return "tcp", addr
 }
 
 func NewConn(sock net.Conn) *Conn {
@@ -33,9 +73,13 @@ func NewConn(sock net.Conn) *Conn {
 }
 
 func NewConnSize(sock net.Conn, bufsize int) *Conn {
+	return NewConnSizes(sock, bufsize, bufsize)
+}
+
+func NewConnSizes(sock net.Conn, rbufsize, wbufsize int) *Conn {
 	conn := &Conn{Sock: sock}
-	conn.Reader = NewDecoderSize(&connReader{Conn: conn}, bufsize)
-	conn.Writer = NewEncoderSize(&connWriter{Conn: conn}, bufsize)
+	conn.Reader = NewDecoderSize(&connReader{Conn: conn}, rbufsize)
+	conn.Writer = NewEncoderSize(&connWriter{Conn: conn}, wbufsize)
 	return conn
 }
 
@@ -49,8 +93,15 @@ type connReader struct {
 }
 
 func (r *connReader) Read(b []byte) (int, error) {
+	var deadline time.Time
 	if timeout := r.ReaderTimeout; timeout != 0 {
-		if err := r.Sock.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		deadline = time.Now().Add(timeout)
+	}
+	if t := r.Reader.Deadline(); !t.IsZero() && (deadline.IsZero() || t.Before(deadline)) {
+		deadline = t
+	}
+	if !deadline.IsZero() {
+		if err := r.Sock.SetReadDeadline(deadline); err != nil {
 			return 0, errors.Trace(err)
 		}
 		r.hasDeadline = true
@@ -92,6 +143,9 @@ func (w *connWriter) Write(b []byte) (int, error) {
 }
 
 func IsTimeout(err error) bool {
+	if errors.Equal(err, ErrDecodeDeadline) {
+		return true
+	}
 	if err := errors.Cause(err); err != nil {
 		e, ok := err.(*net.OpError)
 		if ok {
@@ -5,7 +5,10 @@ package redis
 
 import (
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -116,9 +119,93 @@ func TestConnWriterTimeout(t *testing.T) {
 		_, err := conn1.Reader.Decode()
 		assert.MustNoError(err)
 	}
+	// the write that timed out may have sent part of a reply
 	_, err := conn1.Reader.Decode()
-	assert.Must(err != nil && errors.Equal(err, io.EOF))
+	assert.Must(errors.Equal(err, io.EOF) || errors.Equal(err, ErrIncompleteReply))
 
 	conn1.Close()
 	conn2.Close()
 }
+
+func TestDialTimeoutFrom(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	for _, laddr := range []string{"", "127.0.0.1", "127.0.0.1:0"} {
+		c, err := DialTimeoutFrom(laddr, l.Addr().String(), 1024, time.Second)
+		assert.MustNoError(err)
+		a := c.Sock.LocalAddr().(*net.TCPAddr)
+		assert.Must(a.IP.Equal(net.IPv4(127, 0, 0, 1)))
+		c.Close()
+	}
+
+	_, err = DialTimeoutFrom("not-an-ip:x", l.Addr().String(), 1024, time.Second)
+	assert.Must(err != nil)
+}
+
+func TestDialTimeoutSizes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	c, err := DialTimeoutSizes("", l.Addr().String(), 1024*64, 4096, time.Second)
+	assert.MustNoError(err)
+	defer c.Close()
+	assert.Must(c.Reader.Size() == 1024*64)
+	assert.Must(c.Writer.Size() == 4096)
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codis")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "redis.sock")
+	l, err := net.Listen("unix", path)
+	assert.MustNoError(err)
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		assert.MustNoError(err)
+		conn := NewConn(c)
+		defer conn.Close()
+		_, err = conn.Reader.Decode()
+		assert.MustNoError(err)
+		assert.MustNoError(conn.Writer.Encode(NewString([]byte("PONG")), true))
+	}()
+
+	c, err := DialTimeoutFrom("127.0.0.1", "unix://"+path, 1024, time.Second)
+	assert.MustNoError(err)
+	defer c.Close()
+	assert.MustNoError(c.Writer.Encode(NewArray([]*Resp{NewBulkBytes([]byte("PING"))}), true))
+	resp, err := c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "PONG")
+
+	network, addr := SplitNetworkAddr("127.0.0.1:6379")
+	assert.Must(network == "tcp" && addr == "127.0.0.1:6379")
+}
+
+func TestConnDecodeDeadline(t *testing.T) {
+	conn1, conn2 := newConnPair()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	go func() {
+		for _, c := range []byte("$10\r\n0123456789\r\n") {
+			if _, err := conn2.Sock.Write([]byte{c}); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	}()
+
+	conn1.ReaderTimeout = time.Second
+	conn1.Reader.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	start := time.Now()
+	_, err := conn1.Reader.Decode()
+	assert.Must(err != nil && IsTimeout(err))
+	assert.Must(time.Since(start) < time.Millisecond*500)
+}
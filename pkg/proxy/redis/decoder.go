@@ -6,18 +6,38 @@ package redis
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 )
 
+const (
+	MaxBulkBytesLen = 1024 * 1024 * 512
+	MaxArrayLen     = 1024 * 1024
+	MaxArrayDepth   = 512
+	MaxLineBytesLen = 1024 * 64
+)
+
 var (
-	ErrBadRespCRLFEnd  = errors.New("bad resp CRLF end")
-	ErrBadRespBytesLen = errors.New("bad resp bytes len")
-	ErrBadRespArrayLen = errors.New("bad resp array len")
+	ErrBadRespCRLFEnd    = errors.New("bad resp CRLF end")
+	ErrBadRespBytesLen   = errors.New("bad resp bytes len")
+	ErrBadRespArrayLen   = errors.New("bad resp array len")
+	ErrBadRespArrayDepth = errors.New("bad resp array depth")
+	ErrReplyTooLarge     = errors.New("reply is too large")
+	ErrDecodeDeadline    = errors.New("decode deadline exceeded")
+	ErrBadRespVerbatim   = errors.New("bad resp verbatim string")
+	ErrIncompleteReply   = errors.New("incomplete reply")
+	ErrNotArray          = errors.New("reply is not an array")
+	ErrLineTooLong       = errors.New("line is too long")
 )
 
+// btoi parses short numbers by hand: with at most 9 digits the fast path
+// can't overflow int64, anything longer is left to strconv.ParseInt,
+// which reports out of range values.
 func btoi(b []byte) (int64, error) {
 	if len(b) != 0 && len(b) < 10 {
 		var neg, i = false, 0
@@ -53,29 +73,396 @@ type Decoder struct {
 	*bufio.Reader
 
 	Err error
+
+	// MaxBulkLen and MaxArrayLen bound the length of a single bulk or
+	// array, they default to MaxBulkBytesLen and MaxArrayLen.
+	MaxBulkLen  int64
+	MaxArrayLen int64
+
+	// MaxLineLen bounds the length of a single line, CRLF included, e.g.
+	// a simple string, an error or an inline request, so a peer never
+	// sending the terminator can't grow it without limit. It defaults to
+	// MaxLineBytesLen.
+	MaxLineLen int64
+
+	// MaxReplyBytes limits the size of a single top-level reply, including
+	// nested arrays and all framing bytes. 0 means unlimited.
+	MaxReplyBytes int64
+
+	// StreamBulkLen enables streaming of top-level bulks of at least that
+	// many bytes: the reply is a bulk with a nil Value, and the payload is
+	// left on the connection to be read through Stream. 0 disables
+	// streaming.
+	StreamBulkLen int64
+
+	// OnBulk, if set, is called with the payload of every bulk decoded,
+	// e.g. to checksum or sample values. The slice becomes the Value of
+	// the reply, it must not be modified nor retained. Streamed bulks are
+	// not passed to it.
+	OnBulk func(b []byte)
+
+	// KeepRaw makes Decode and DecodeInto set Resp.Raw to the bytes of
+	// each top-level reply, from its type byte to its final CRLF, e.g. to
+	// cache or relay replies as they are. Raw is a copy owned by the
+	// reply, never a view of the read buffer, so it stays valid after
+	// later reads at the cost of holding every reply twice. It is not set
+	// for streamed bulks.
+	KeepRaw bool
+
+	stream *BulkReader
+
+	// iterating counts the elements left of an array being decoded by
+	// DecodeArrayIter.
+	iterating int64
+
+	raw     []byte
+	keeping bool
+
+	// owned tells whether the bufio.Reader was created by the decoder,
+	// which is then free to reuse it in Reset.
+	owned bool
+
+	deadline time.Time
+
+	start    int64
+	offset   int64
+	expect   int64
+	decoding RespType
+}
+
+type DecodeError struct {
+	Offset int64
+	Type   RespType
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s at offset %d while decoding %s", e.Err, e.Offset, e.Type)
+}
+
+func (e *DecodeError) Cause() error {
+	return e.Err
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// IncompleteReplyError tells that the stream ended in the middle of a
+// reply, e.g. the backend crashed or closed the connection while sending
+// it, as opposed to sending garbage.
+type IncompleteReplyError struct {
+	// Received is the number of bytes of the reply that were read.
+	Received int64
+	// Expected is the size the reply is known to have at least, from the
+	// lengths read so far, or 0 if none was.
+	Expected int64
+}
+
+func (e *IncompleteReplyError) Error() string {
+	if e.Expected == 0 {
+		return fmt.Sprintf("%s, received %d bytes", ErrIncompleteReply, e.Received)
+	}
+	return fmt.Sprintf("%s, received %d of at least %d bytes", ErrIncompleteReply, e.Received, e.Expected)
+}
+
+func (e *IncompleteReplyError) Cause() error {
+	return ErrIncompleteReply
+}
+
+func (e *IncompleteReplyError) Unwrap() error {
+	return ErrIncompleteReply
 }
 
 func NewDecoder(br *bufio.Reader) *Decoder {
-	return &Decoder{Reader: br}
+	return &Decoder{
+		Reader:     br,
+		MaxBulkLen: MaxBulkBytesLen, MaxArrayLen: MaxArrayLen,
+	}
 }
 
 func NewDecoderSize(r io.Reader, size int) *Decoder {
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReaderSize(r, size)
+	if br, ok := r.(*bufio.Reader); ok {
+		return NewDecoder(br)
+	}
+	d := NewDecoder(nil)
+	d.Reader = bufio.NewReaderSize(&deadlineReader{Reader: r, d: d}, size)
+	d.owned = true
+	return d
+}
+
+// Reset makes d decode from r as if it were new, clearing any sticky
+// error, unread stream and deadline, while keeping its limits, OnBulk and
+// the buffer it allocated, so decoders can be pooled. Like in
+// NewDecoderSize, a *bufio.Reader is used as it is.
+func (d *Decoder) Reset(r io.Reader) {
+	if br, ok := r.(*bufio.Reader); ok {
+		d.Reader, d.owned = br, false
+	} else if d.owned {
+		d.Reader.Reset(&deadlineReader{Reader: r, d: d})
+	} else {
+		d.Reader, d.owned = bufio.NewReader(&deadlineReader{Reader: r, d: d}), true
+	}
+	d.Err, d.stream, d.iterating = nil, nil, 0
+	d.raw, d.keeping = nil, false
+	d.deadline = time.Time{}
+	d.start, d.offset, d.expect = 0, 0, 0
+	d.decoding = 0
+}
+
+// SetDeadline bounds the time decoding may take as a whole, however many
+// reads from the underlying reader it needs, so a peer trickling bytes
+// can't keep a Decode alive forever. Once it is exceeded, reading fails
+// with ErrDecodeDeadline, which is sticky like any other decode error. It
+// is only enforced for decoders created by NewDecoderSize over a reader
+// that is not a *bufio.Reader. A zero t means no deadline.
+func (d *Decoder) SetDeadline(t time.Time) {
+	d.deadline = t
+}
+
+func (d *Decoder) Deadline() time.Time {
+	return d.deadline
+}
+
+type deadlineReader struct {
+	io.Reader
+	d *Decoder
+}
+
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	if t := r.d.deadline; !t.IsZero() && !time.Now().Before(t) {
+		return 0, errors.Trace(ErrDecodeDeadline)
 	}
-	return &Decoder{Reader: br}
+	return r.Reader.Read(b)
+}
+
+func (d *Decoder) maxBulkLen() int64 {
+	if d.MaxBulkLen <= 0 {
+		return MaxBulkBytesLen
+	}
+	return d.MaxBulkLen
+}
+
+func (d *Decoder) maxArrayLen() int64 {
+	if d.MaxArrayLen <= 0 {
+		return MaxArrayLen
+	}
+	return d.MaxArrayLen
+}
+
+func (d *Decoder) maxLineLen() int64 {
+	if d.MaxLineLen <= 0 {
+		return MaxLineBytesLen
+	}
+	return d.MaxLineLen
+}
+
+// Offset returns the number of bytes consumed by the decoder so far.
+func (d *Decoder) Offset() int64 {
+	return d.offset
 }
 
 func (d *Decoder) Decode() (*Resp, error) {
 	if d.Err != nil {
 		return nil, d.Err
 	}
+	if err := d.drainPending(); err != nil {
+		d.Err = err
+		return nil, d.Err
+	}
+	d.start, d.expect = d.offset, 0
+	d.beginRaw()
 	r, err := d.decodeResp(0)
+	raw := d.endRaw()
+	if err != nil {
+		d.Err = d.wrapError(err)
+		return nil, d.Err
+	}
+	if d.stream == nil {
+		r.Raw = raw
+	}
+	return r, nil
+}
+
+// Stream returns the payload of the bulk streamed by the last Decode or
+// DecodeInto, nil if that reply was not streamed, see StreamBulkLen.
+func (d *Decoder) Stream() *BulkReader {
+	return d.stream
+}
+
+// DecodeInto decodes the next resp into r, reusing r.Array when it is
+// large enough. Elements of arrays are taken from a shared pool instead
+// of being allocated, see ReleaseResp.
+func (d *Decoder) DecodeInto(r *Resp) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	if err := d.drainPending(); err != nil {
+		d.Err = err
+		return d.Err
+	}
+	d.start, d.expect = d.offset, 0
+	d.beginRaw()
+	err := d.decodeRespInto(r, 0, true)
+	r.Raw = nil
+	if raw := d.endRaw(); err == nil && d.stream == nil {
+		r.Raw = raw
+	}
 	if err != nil {
+		d.Err = d.wrapError(err)
+		return d.Err
+	}
+	return nil
+}
+
+// DecodeArrayIter decodes the header of the next reply, which must be an
+// array, and returns its length and a func yielding its elements one at
+// a time, so a huge array can be relayed without holding all of it. A
+// nil array has length -1 and no elements.
+//
+// next returns false once all elements have been returned. An error is
+// sticky like in Decode: next keeps returning it, and so does the
+// decoder. Decoding the next reply skips the elements not iterated over,
+// after which next must not be called anymore. MaxReplyBytes applies to
+// the array as a whole.
+//
+// If the reply is not an array, ErrNotArray is returned and nothing is
+// consumed, the reply can be decoded as usual.
+func (d *Decoder) DecodeArrayIter() (int64, func() (*Resp, bool, error), error) {
+	if d.Err != nil {
+		return 0, nil, d.Err
+	}
+	if err := d.drainPending(); err != nil {
 		d.Err = err
+		return 0, nil, d.Err
+	}
+	d.start, d.expect = d.offset, 0
+	if b, err := d.Peek(1); err != nil {
+		d.Err = errors.Trace(err)
+		return 0, nil, d.Err
+	} else if RespType(b[0]) != TypeArray {
+		return 0, nil, errors.Trace(ErrNotArray)
+	}
+	d.readByte()
+	d.decoding = TypeArray
+	n, err := d.decodeInt()
+	if err == nil && (n < -1 || n > d.maxArrayLen()) {
+		err = errors.Trace(ErrBadRespArrayLen)
+	}
+	if err == nil && n > 0 {
+		err = d.checkReplySize(n * 3)
+	}
+	if err != nil {
+		d.Err = d.wrapError(err)
+		return 0, nil, d.Err
+	}
+	if n > 0 {
+		d.iterating = n
+	}
+	next := func() (*Resp, bool, error) {
+		if d.Err != nil {
+			return nil, false, d.Err
+		}
+		if d.iterating == 0 {
+			return nil, false, nil
+		}
+		d.iterating--
+		d.decoding = TypeArray
+		r, err := d.decodeResp(1)
+		if err != nil {
+			d.Err = d.wrapError(err)
+			return nil, false, d.Err
+		}
+		return r, true, nil
+	}
+	return n, next, nil
+}
+
+// wrapError records where a reply went wrong. Errors raised before any
+// byte of the reply has been consumed, e.g. EOF of a closed connection,
+// are returned as they are, while EOF in the middle of a reply becomes
+// an IncompleteReplyError.
+func (d *Decoder) wrapError(err error) error {
+	if d.offset == d.start {
+		return err
+	}
+	switch errors.Cause(err) {
+	case io.EOF, io.ErrUnexpectedEOF:
+		err = &IncompleteReplyError{Received: d.offset - d.start, Expected: d.expect}
+	}
+	return &DecodeError{Offset: d.offset, Type: d.decoding, Err: err}
+}
+
+// checkReplySize fails once the current reply, together with the pending
+// bytes it is known to still contain, exceeds MaxReplyBytes.
+func (d *Decoder) checkReplySize(pending int64) error {
+	if d.MaxReplyBytes > 0 && d.offset-d.start+pending > d.MaxReplyBytes {
+		return errors.Trace(ErrReplyTooLarge)
+	}
+	return nil
+}
+
+func (d *Decoder) beginRaw() {
+	d.raw, d.keeping = nil, d.KeepRaw
+}
+
+func (d *Decoder) endRaw() []byte {
+	raw := d.raw
+	d.raw, d.keeping = nil, false
+	return raw
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.ReadByte()
+	if err == nil {
+		d.offset++
+		if d.keeping {
+			d.raw = append(d.raw, b)
+		}
+	}
+	return b, err
+}
+
+func (d *Decoder) unreadByte() error {
+	err := d.UnreadByte()
+	if err == nil {
+		d.offset--
+		if d.keeping {
+			d.raw = d.raw[:len(d.raw)-1]
+		}
 	}
-	return r, err
+	return err
+}
+
+func (d *Decoder) readBytes(delim byte) ([]byte, error) {
+	var b []byte
+	var err error
+	for {
+		var p []byte
+		p, err = d.ReadSlice(delim)
+		if int64(len(b)+len(p)) > d.maxLineLen() {
+			d.offset += int64(len(b) + len(p))
+			return nil, errors.Trace(ErrLineTooLong)
+		}
+		b = append(b, p...)
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	d.offset += int64(len(b))
+	if d.keeping {
+		d.raw = append(d.raw, b...)
+	}
+	return b, err
+}
+
+func (d *Decoder) readFull(b []byte) error {
+	n, err := io.ReadFull(d.Reader, b)
+	d.offset += int64(n)
+	if d.keeping {
+		d.raw = append(d.raw, b[:n]...)
+	}
+	return err
 }
 
 func Decode(br *bufio.Reader) (*Resp, error) {
@@ -86,42 +473,88 @@ func DecodeFromBytes(p []byte) (*Resp, error) {
 	return Decode(bufio.NewReader(bytes.NewReader(p)))
 }
 
+var respPool = sync.Pool{
+	New: func() interface{} {
+		return &Resp{}
+	},
+}
+
+func putResp(r *Resp) {
+	*r = Resp{}
+	respPool.Put(r)
+}
+
+// ReleaseResp returns r and all elements of its array to the pool used
+// by DecodeInto, r must not be used after that. Only the Resp nodes are
+// recycled: the Value slices are owned copies that are simply dropped,
+// so a Value still referenced elsewhere stays valid.
+func ReleaseResp(r *Resp) {
+	if r == nil {
+		return
+	}
+	for _, x := range r.Array {
+		ReleaseResp(x)
+	}
+	putResp(r)
+}
+
 func (d *Decoder) decodeResp(depth int) (*Resp, error) {
-	b, err := d.ReadByte()
+	r := &Resp{}
+	if err := d.decodeRespInto(r, depth, false); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (d *Decoder) decodeRespInto(r *Resp, depth int, pooled bool) error {
+	b, err := d.readByte()
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
 	}
+	d.decoding = RespType(b)
 	switch t := RespType(b); t {
-	case TypeString, TypeError, TypeInt:
-		r := &Resp{Type: t}
+	case TypeString, TypeError, TypeInt, TypeDouble:
+		r.Type, r.Array = t, nil
 		r.Value, err = d.decodeTextBytes()
-		return r, err
+		return err
 	case TypeBulkBytes:
-		r := &Resp{Type: t}
-		r.Value, err = d.decodeBulkBytes()
-		return r, err
-	case TypeArray:
-		r := &Resp{Type: t}
-		r.Array, err = d.decodeArray(depth)
-		return r, err
+		r.Type, r.Array = t, nil
+		if depth == 0 && d.StreamBulkLen > 0 {
+			r.Value, err = d.decodeBulkStream()
+		} else {
+			r.Value, err = d.decodeBulkBytes()
+		}
+		return err
+	case TypeArray, TypePush:
+		r.Type, r.Value = t, nil
+		r.Array, err = d.decodeArray(r.Array, depth, pooled)
+		return err
+	case TypeVerbatim:
+		r.Type, r.Array = t, nil
+		r.Value, err = d.decodeVerbatim()
+		return err
 	default:
 		if depth != 0 {
-			return nil, errors.Errorf("bad resp type %s", t)
+			return errors.Errorf("bad resp type %s", t)
 		}
-		if err := d.UnreadByte(); err != nil {
-			return nil, errors.Trace(err)
+		if err := d.unreadByte(); err != nil {
+			return errors.Trace(err)
 		}
-		r := &Resp{Type: TypeArray}
+		d.decoding = TypeArray
+		r.Type, r.Value = TypeArray, nil
 		r.Array, err = d.decodeSingleLineBulkBytesArray()
-		return r, err
+		return err
 	}
 }
 
 func (d *Decoder) decodeTextBytes() ([]byte, error) {
-	b, err := d.ReadBytes('\n')
+	b, err := d.readBytes('\n')
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	if err := d.checkReplySize(0); err != nil {
+		return nil, err
+	}
 	if n := len(b) - 2; n < 0 || b[n] != '\r' {
 		return nil, errors.Trace(ErrBadRespCRLFEnd)
 	} else {
@@ -150,34 +583,237 @@ func (d *Decoder) decodeBulkBytes() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if n < -1 {
+	if n < -1 || n > d.maxBulkLen() {
 		return nil, errors.Trace(ErrBadRespBytesLen)
-	} else if n == -1 {
+	}
+	return d.decodeBulkPayload(n)
+}
+
+// decodeVerbatim reads a verbatim string, a bulk whose payload starts
+// with a 3 characters format and a colon, e.g. =9\r\ntxt:hello\r\n.
+func (d *Decoder) decodeVerbatim() ([]byte, error) {
+	n, err := d.decodeInt()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > d.maxBulkLen() {
+		return nil, errors.Trace(ErrBadRespBytesLen)
+	}
+	b, err := d.decodeBulkPayload(n)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 || b[3] != ':' {
+		return nil, errors.Trace(ErrBadRespVerbatim)
+	}
+	return b, nil
+}
+
+func (d *Decoder) decodeBulkPayload(n int64) ([]byte, error) {
+	if n == -1 {
 		return nil, nil
 	}
-	b := make([]byte, n+2)
-	if _, err := io.ReadFull(d.Reader, b); err != nil {
+	if err := d.checkReplySize(n + 2); err != nil {
+		return nil, err
+	}
+	d.expect = d.offset - d.start + n + 2
+	b, err := d.readBulk(n + 2)
+	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	if b[n] != '\r' || b[n+1] != '\n' {
 		return nil, errors.Trace(ErrBadRespCRLFEnd)
 	}
+	if d.OnBulk != nil {
+		d.OnBulk(b[:n])
+	}
 	return b[:n], nil
 }
 
-func (d *Decoder) decodeArray(depth int) ([]*Resp, error) {
+func (d *Decoder) decodeBulkStream() ([]byte, error) {
 	n, err := d.decodeInt()
 	if err != nil {
 		return nil, err
 	}
-	if n < -1 {
+	if n < -1 || n > d.maxBulkLen() {
+		return nil, errors.Trace(ErrBadRespBytesLen)
+	} else if n < d.StreamBulkLen {
+		return d.decodeBulkPayload(n)
+	}
+	if err := d.checkReplySize(n + 2); err != nil {
+		return nil, err
+	}
+	d.stream = &BulkReader{d: d, size: n, left: n}
+	return nil, nil
+}
+
+// drainPending skips what is left of the previous reply, a streamed bulk
+// or the elements of an array not iterated over.
+func (d *Decoder) drainPending() error {
+	if err := d.drainStream(); err != nil {
+		return err
+	}
+	for d.iterating != 0 {
+		d.iterating--
+		if _, err := d.decodeResp(1); err != nil {
+			return d.wrapError(err)
+		}
+	}
+	return nil
+}
+
+// drainStream discards whatever is left of the last streamed bulk, so
+// the next reply is decoded from the right position.
+func (d *Decoder) drainStream() error {
+	s := d.stream
+	if s == nil {
+		return nil
+	}
+	d.stream = nil
+	return s.drain()
+}
+
+// BulkReader reads the payload of a streamed bulk directly from the
+// decoder's connection. The trailing CRLF is consumed and verified as
+// soon as the last byte of the payload has been read, after which Read
+// returns io.EOF. Calling Decode again discards any unread payload, and
+// the BulkReader must not be used anymore.
+type BulkReader struct {
+	d *Decoder
+
+	size, left int64
+
+	err error
+}
+
+// Size returns the total length of the payload.
+func (s *BulkReader) Size() int64 {
+	return s.size
+}
+
+// Len returns the number of bytes of the payload not read yet.
+func (s *BulkReader) Len() int64 {
+	return s.left
+}
+
+func (s *BulkReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.d.Reader.Read(p)
+	s.d.offset += int64(n)
+	s.left -= int64(n)
+	switch {
+	case err == io.EOF:
+		s.err = errors.Trace(io.ErrUnexpectedEOF)
+	case err != nil:
+		s.err = errors.Trace(err)
+	case s.left == 0:
+		s.err = s.finish()
+	}
+	if s.err == io.EOF && n != 0 {
+		return n, nil
+	}
+	return n, s.err
+}
+
+func (s *BulkReader) finish() error {
+	var b [2]byte
+	if err := s.d.readFull(b[:]); err != nil {
+		return errors.Trace(err)
+	}
+	if b[0] != '\r' || b[1] != '\n' {
+		return errors.Trace(ErrBadRespCRLFEnd)
+	}
+	return io.EOF
+}
+
+func (s *BulkReader) drain() error {
+	if s.err == nil {
+		n, err := s.d.Discard(int(s.left))
+		s.d.offset += int64(n)
+		s.left -= int64(n)
+		if err != nil {
+			s.err = errors.Trace(err)
+		} else {
+			s.err = s.finish()
+		}
+	}
+	if s.err != io.EOF {
+		return s.err
+	}
+	return nil
+}
+
+// Bulks and arrays larger than bulkPreallocLen and arrayPreallocLen are
+// read in growing chunks, so that a bogus length can't make the decoder
+// allocate much more memory than the bytes actually received.
+const (
+	bulkPreallocLen  = 1024 * 1024
+	arrayPreallocLen = 1024
+)
+
+func (d *Decoder) readBulk(size int64) ([]byte, error) {
+	n := size
+	if n > bulkPreallocLen {
+		n = bulkPreallocLen
+	}
+	b := make([]byte, n)
+	if err := d.readFull(b); err != nil {
+		return nil, err
+	}
+	for int64(len(b)) < size {
+		n := int64(len(b)) * 2
+		if n > size {
+			n = size
+		}
+		p := make([]byte, n)
+		copy(p, b)
+		if err := d.readFull(p[len(b):]); err != nil {
+			return nil, err
+		}
+		b = p
+	}
+	return b, nil
+}
+
+func (d *Decoder) decodeArray(a []*Resp, depth int, pooled bool) ([]*Resp, error) {
+	n, err := d.decodeInt()
+	if err != nil {
+		return nil, err
+	}
+	if n < -1 || n > d.maxArrayLen() {
 		return nil, errors.Trace(ErrBadRespArrayLen)
 	} else if n == -1 {
 		return nil, nil
 	}
-	a := make([]*Resp, n)
-	for i := 0; i < len(a); i++ {
-		if a[i], err = d.decodeResp(depth + 1); err != nil {
+	// each element takes at least 3 bytes, e.g. "+\r\n"
+	if err := d.checkReplySize(n * 3); err != nil {
+		return nil, err
+	}
+	if depth >= MaxArrayDepth {
+		return nil, errors.Trace(ErrBadRespArrayDepth)
+	}
+	if a != nil && int64(cap(a)) >= n {
+		a = a[:0]
+	} else if n > arrayPreallocLen {
+		a = make([]*Resp, 0, arrayPreallocLen)
+	} else {
+		a = make([]*Resp, 0, n)
+	}
+	for i := int64(0); i < n; i++ {
+		d.decoding = TypeArray
+		var x *Resp
+		if pooled {
+			x = respPool.Get().(*Resp)
+		} else {
+			x = &Resp{}
+		}
+		a = append(a, x)
+		if err := d.decodeRespInto(x, depth+1, pooled); err != nil {
 			return nil, err
 		}
 	}
@@ -189,17 +825,138 @@ func (d *Decoder) decodeSingleLineBulkBytesArray() ([]*Resp, error) {
 	if err != nil {
 		return nil, err
 	}
-	a := make([]*Resp, 0, 4)
-	for l, r := 0, 0; r <= len(b); r++ {
-		if r == len(b) || b[r] == ' ' {
-			if l < r {
-				a = append(a, &Resp{
-					Type:  TypeBulkBytes,
-					Value: b[l:r],
-				})
+	args, err := splitInlineArgs(b)
+	if err != nil {
+		return nil, err
+	}
+	a := make([]*Resp, 0, len(args))
+	for _, arg := range args {
+		a = append(a, &Resp{
+			Type:  TypeBulkBytes,
+			Value: arg,
+		})
+	}
+	return a, nil
+}
+
+var ErrBadInlineQuotes = errors.New("unbalanced quotes in inline request")
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// SplitInlineArgs splits a command written inline, e.g. in a config file,
+// into its arguments, see splitInlineArgs.
+func SplitInlineArgs(s string) ([][]byte, error) {
+	return splitInlineArgs([]byte(s))
+}
+
+// splitInlineArgs splits an inline command the way redis-cli does:
+// arguments are separated by spaces, and may be wrapped in double quotes
+// (supporting \xHH, \n, \r, \t, \b, \a and \<char> escapes) or single
+// quotes (supporting only \' escape). A closing quote must be followed
+// by a space or the end of line.
+func splitInlineArgs(b []byte) ([][]byte, error) {
+	var args [][]byte
+	var i = 0
+	for {
+		for i < len(b) && isSpace(b[i]) {
+			i++
+		}
+		if i == len(b) {
+			return args, nil
+		}
+		var arg = []byte{}
+		var dquote, squote = false, false
+		for done := false; !done; i++ {
+			switch {
+			case dquote:
+				if i == len(b) {
+					return nil, errors.Trace(ErrBadInlineQuotes)
+				}
+				switch c := b[i]; {
+				case c == '\\' && i+3 < len(b) && b[i+1] == 'x':
+					h, ok1 := unhex(b[i+2])
+					l, ok2 := unhex(b[i+3])
+					if ok1 && ok2 {
+						arg = append(arg, h<<4|l)
+						i += 3
+					} else {
+						arg = append(arg, 'x')
+						i += 1
+					}
+				case c == '\\' && i+1 < len(b):
+					i++
+					switch c = b[i]; c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					arg = append(arg, c)
+				case c == '"':
+					if i+1 < len(b) && !isSpace(b[i+1]) {
+						return nil, errors.Trace(ErrBadInlineQuotes)
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case squote:
+				if i == len(b) {
+					return nil, errors.Trace(ErrBadInlineQuotes)
+				}
+				switch c := b[i]; {
+				case c == '\\' && i+1 < len(b) && b[i+1] == '\'':
+					arg = append(arg, '\'')
+					i++
+				case c == '\'':
+					if i+1 < len(b) && !isSpace(b[i+1]) {
+						return nil, errors.Trace(ErrBadInlineQuotes)
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(b) {
+					done, i = true, i-1
+					break
+				}
+				switch c := b[i]; {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					dquote = true
+				case c == '\'':
+					squote = true
+				default:
+					arg = append(arg, c)
+				}
 			}
-			l = r + 1
 		}
+		args = append(args, arg)
 	}
-	return a, nil
 }
@@ -4,10 +4,18 @@
 package redis
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 )
 
 func TestBtoi(t *testing.T) {
@@ -18,6 +26,31 @@ func TestBtoi(t *testing.T) {
 	}
 }
 
+func TestBtoiBoundary(t *testing.T) {
+	test := map[string]int64{
+		"999999999":            999999999,
+		"-99999999":            -99999999,
+		"+99999999":            99999999,
+		"9999999999":           9999999999,
+		"-999999999":           -999999999,
+		"9223372036854775807":  math.MaxInt64,
+		"-9223372036854775808": math.MinInt64,
+	}
+	for s, v := range test {
+		n, err := btoi([]byte(s))
+		assert.MustNoError(err)
+		assert.Must(n == v)
+	}
+	for _, s := range []string{
+		"", "-", "+", "1-", "12a", " 1",
+		"9223372036854775808", "-9223372036854775809",
+		"99999999999999999999",
+	} {
+		_, err := btoi([]byte(s))
+		assert.Must(err != nil)
+	}
+}
+
 func TestDecodeInvalidRequests(t *testing.T) {
 	test := []string{
 		"*hello\r\n",
@@ -82,6 +115,41 @@ func TestDecodeSimpleRequest3(t *testing.T) {
 	}
 }
 
+func TestDecodeInlineQuotes(t *testing.T) {
+	test := map[string][]string{
+		"SET key \"hello world\"\r\n": {"SET", "key", "hello world"},
+		"SET key ''\r\n":              {"SET", "key", ""},
+		"SET key \"\"\r\n":            {"SET", "key", ""},
+		"SET key 'say \"hi\"'\r\n":    {"SET", "key", "say \"hi\""},
+		"SET key \"say 'hi'\"\r\n":    {"SET", "key", "say 'hi'"},
+		"SET key \"a\\\"b\"\r\n":      {"SET", "key", "a\"b"},
+		"SET key 'a\\'b'\r\n":         {"SET", "key", "a'b"},
+		"SET key \"\\x41\\n\\t\"\r\n": {"SET", "key", "A\n\t"},
+		"SET key\t\"x\"\r\n":          {"SET", "key", "x"},
+		"SET k\"e y\"\r\n":            {"SET", "ke y"},
+	}
+	for s, args := range test {
+		resp, err := DecodeFromBytes([]byte(s))
+		assert.MustNoError(err)
+		assert.Must(resp.IsArray())
+		assert.Must(len(resp.Array) == len(args))
+		for i, arg := range args {
+			assert.Must(resp.Array[i].IsBulkBytes())
+			assert.Must(string(resp.Array[i].Value) == arg)
+		}
+	}
+	for _, s := range []string{
+		"SET key \"hello\r\n",
+		"SET key 'hello\r\n",
+		"SET key \"hello\"world\r\n",
+		"SET key 'hello'world\r\n",
+		"SET key \"hello\\\"\r\n",
+	} {
+		_, err := DecodeFromBytes([]byte(s))
+		assert.Must(errors.Equal(err, ErrBadInlineQuotes))
+	}
+}
+
 func TestDecodeBulkBytes(t *testing.T) {
 	test := "*2\r\n$4\r\nLLEN\r\n$6\r\nmylist\r\n"
 	resp, err := DecodeFromBytes([]byte(test))
@@ -112,3 +180,538 @@ func TestDecoder(t *testing.T) {
 		assert.MustNoError(err)
 	}
 }
+
+func TestDecodeInto(t *testing.T) {
+	var r = &Resp{}
+	for _, s := range []string{
+		"*2\r\n$3\r\nfoo\r\n*1\r\n:1\r\n",
+		"$6\r\nfoobar\r\n",
+		"*1\r\n$-1\r\n",
+	} {
+		d := NewDecoderSize(bytes.NewReader([]byte(s)), 1024)
+		assert.MustNoError(d.DecodeInto(r))
+		b, err := EncodeToBytes(r)
+		assert.MustNoError(err)
+		assert.Must(string(b) == s)
+	}
+}
+
+func TestReleaseResp(t *testing.T) {
+	var r = &Resp{}
+	d := NewDecoderSize(bytes.NewReader([]byte("*2\r\n$3\r\nfoo\r\n*1\r\n$3\r\nbar\r\n")), 1024)
+	assert.MustNoError(d.DecodeInto(r))
+	foo, sub := r.Array[0].Value, r.Array[1]
+	ReleaseResp(r)
+	assert.Must(r.Array == nil && sub.Array == nil)
+	assert.Must(string(foo) == "foo")
+}
+
+func newMGetReply(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString("*" + strconv.Itoa(n) + "\r\n")
+	for i := 0; i < n; i++ {
+		b.WriteString("$8\r\nvalue-" + strconv.Itoa(i%10) + strconv.Itoa(i%10) + "\r\n")
+	}
+	return b.Bytes()
+}
+
+func BenchmarkDecodeMGetReply(b *testing.B) {
+	p := newMGetReply(64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d := NewDecoderSize(bytes.NewReader(p), 4096)
+		if _, err := d.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeIntoMGetReply(b *testing.B) {
+	p := newMGetReply(64)
+	r := &Resp{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d := NewDecoderSize(bytes.NewReader(p), 4096)
+		if err := d.DecodeInto(r); err != nil {
+			b.Fatal(err)
+		}
+		for _, x := range r.Array {
+			ReleaseResp(x)
+		}
+	}
+}
+
+func TestDecodeErrorOffset(t *testing.T) {
+	_, err := DecodeFromBytes([]byte("*1\r\n$3\r\nfooX\r\n"))
+	assert.Must(errors.Equal(err, ErrBadRespCRLFEnd))
+	e, ok := err.(*DecodeError)
+	assert.Must(ok && e.Offset == 13 && e.Type == TypeBulkBytes)
+	assert.Must(err.Error() == "bad resp CRLF end at offset 13 while decoding <bulkbytes>")
+
+	_, err = DecodeFromBytes([]byte("*2\r\n:1\r\n"))
+	assert.Must(errors.Equal(err, ErrIncompleteReply))
+	e, ok = err.(*DecodeError)
+	assert.Must(ok && e.Offset == 8 && e.Type == TypeArray)
+
+	_, err = DecodeFromBytes(nil)
+	assert.Must(err != nil && errors.Cause(err) == io.EOF)
+	_, ok = err.(*DecodeError)
+	assert.Must(!ok)
+}
+
+func TestDecodeIncompleteReply(t *testing.T) {
+	for _, s := range []string{"$6\r\nfoobar\r\n", "*2\r\n$3\r\nfoo\r\n:1\r\n"} {
+		for i := 1; i < len(s); i++ {
+			_, err := DecodeFromBytes([]byte(s[:i]))
+			assert.Must(errors.Equal(err, ErrIncompleteReply))
+			e, ok := err.(*DecodeError).Err.(*IncompleteReplyError)
+			assert.Must(ok && e.Received == int64(i))
+		}
+	}
+
+	_, err := DecodeFromBytes([]byte("$6\r\nfoo"))
+	e := err.(*DecodeError).Err.(*IncompleteReplyError)
+	assert.Must(e.Received == 7 && e.Expected == 12)
+	assert.Must(e.Error() == "incomplete reply, received 7 of at least 12 bytes")
+
+	_, err = DecodeFromBytes([]byte("*2\r\n$3\r\nfoo\r\n:1"))
+	e = err.(*DecodeError).Err.(*IncompleteReplyError)
+	assert.Must(e.Received == 15 && e.Expected == 13)
+
+	_, err = DecodeFromBytes([]byte("*2\r\n"))
+	e = err.(*DecodeError).Err.(*IncompleteReplyError)
+	assert.Must(e.Received == 4 && e.Expected == 0)
+	assert.Must(e.Error() == "incomplete reply, received 4 bytes")
+
+	_, err = DecodeFromBytes([]byte("*2\r\n$3\r\nfooX\r\n"))
+	assert.Must(errors.Equal(err, ErrBadRespCRLFEnd))
+}
+
+func TestDecodeMaxReplyBytes(t *testing.T) {
+	var test = map[string]bool{
+		"$6\r\nfoobar\r\n":                        true,
+		"$17\r\nfoobarfoobarfooba\r\n":            false,
+		"*2\r\n$1\r\na\r\n$1\r\nb\r\n":            true,
+		"*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n": false,
+		"*1\r\n*1\r\n*1\r\n*1\r\n:1\r\n":          true,
+		"*1000\r\n":                               false,
+	}
+	for s, ok := range test {
+		d := NewDecoderSize(bytes.NewReader([]byte(s)), 1024)
+		d.MaxReplyBytes = 20
+		_, err := d.Decode()
+		if ok {
+			assert.MustNoError(err)
+		} else {
+			assert.Must(errors.Equal(err, ErrReplyTooLarge))
+		}
+	}
+}
+
+func TestDecodeMaxLen(t *testing.T) {
+	newDecoder := func(s string) *Decoder {
+		d := NewDecoderSize(bytes.NewReader([]byte(s)), 1024)
+		d.MaxBulkLen, d.MaxArrayLen = 4, 2
+		return d
+	}
+	_, err := newDecoder("$4\r\nhell\r\n").Decode()
+	assert.MustNoError(err)
+	_, err = newDecoder("$5\r\nhello\r\n").Decode()
+	assert.Must(errors.Equal(err, ErrBadRespBytesLen))
+	_, err = newDecoder("*2\r\n:1\r\n:2\r\n").Decode()
+	assert.MustNoError(err)
+	_, err = newDecoder("*3\r\n:1\r\n:2\r\n:3\r\n").Decode()
+	assert.Must(errors.Equal(err, ErrBadRespArrayLen))
+
+	_, err = DecodeFromBytes([]byte("*1048577\r\n"))
+	assert.Must(errors.Equal(err, ErrBadRespArrayLen))
+}
+
+func TestDecodeBulkStream(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+	var b bytes.Buffer
+	for i := 0; i < 3; i++ {
+		b.WriteString("$100\r\n")
+		b.Write(payload)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("$3\r\nfoo\r\n*1\r\n$100\r\n")
+	b.Write(payload)
+	b.WriteString("\r\n+OK\r\n")
+
+	d := NewDecoderSize(bytes.NewReader(b.Bytes()), 16)
+	d.StreamBulkLen = 64
+
+	// fully read
+	r, err := d.Decode()
+	assert.MustNoError(err)
+	assert.Must(r.IsBulkBytes() && r.Value == nil)
+	s := d.Stream()
+	assert.Must(s != nil && s.Size() == 100)
+	p := &bytes.Buffer{}
+	_, err = io.Copy(p, s)
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(p.Bytes(), payload))
+	assert.Must(s.Len() == 0)
+
+	// partially read, the rest is drained by the next Decode
+	_, err = d.Decode()
+	assert.MustNoError(err)
+	s = d.Stream()
+	_, err = io.ReadFull(s, make([]byte, 10))
+	assert.MustNoError(err)
+	assert.Must(s.Len() == 90)
+
+	// not read at all
+	_, err = d.Decode()
+	assert.MustNoError(err)
+	assert.Must(d.Stream() != nil)
+
+	r, err = d.Decode()
+	assert.MustNoError(err)
+	assert.Must(d.Stream() == nil && string(r.Value) == "foo")
+
+	// bulks inside arrays are never streamed
+	r, err = d.Decode()
+	assert.MustNoError(err)
+	assert.Must(len(r.Array) == 1 && d.Stream() == nil)
+	assert.Must(bytes.Equal(r.Array[0].Value, payload))
+
+	r, err = d.Decode()
+	assert.MustNoError(err)
+	assert.Must(r.IsString() && string(r.Value) == "OK" && d.Stream() == nil)
+	assert.Must(d.Offset() == int64(b.Len()))
+}
+
+func TestDecodeBulkStreamBadCRLF(t *testing.T) {
+	d := NewDecoderSize(bytes.NewReader([]byte("$4\r\nfoobar\r\n")), 16)
+	d.StreamBulkLen = 1
+	_, err := d.Decode()
+	assert.MustNoError(err)
+	_, err = io.Copy(&bytes.Buffer{}, d.Stream())
+	assert.Must(errors.Equal(err, ErrBadRespCRLFEnd))
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrBadRespCRLFEnd))
+
+	d = NewDecoderSize(bytes.NewReader([]byte("$4\r\nfo")), 16)
+	d.StreamBulkLen = 1
+	_, err = d.Decode()
+	assert.MustNoError(err)
+	_, err = d.Decode()
+	assert.Must(err != nil)
+}
+
+func TestDecodeBogusLength(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for _, s := range []string{
+		"$536870912\r\nfoobar",
+		"*1048576\r\n:1\r\n",
+		"*1048576\r\n*1048576\r\n*1048576\r\n*1048576\r\n",
+	} {
+		_, err := DecodeFromBytes([]byte(s))
+		assert.Must(errors.Equal(err, ErrIncompleteReply))
+	}
+	runtime.ReadMemStats(&after)
+	assert.Must(after.TotalAlloc-before.TotalAlloc < 1024*1024*16)
+}
+
+func TestDecodeMaxArrayDepth(t *testing.T) {
+	s := strings.Repeat("*1\r\n", MaxArrayDepth) + ":1\r\n"
+	_, err := DecodeFromBytes([]byte(s))
+	assert.MustNoError(err)
+	s = strings.Repeat("*1\r\n", MaxArrayDepth+1) + ":1\r\n"
+	_, err = DecodeFromBytes([]byte(s))
+	assert.Must(errors.Equal(err, ErrBadRespArrayDepth))
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, s := range []string{
+		"+OK\r\n",
+		"-ERR\r\n",
+		":-1\r\n",
+		"$6\r\nfoobar\r\n",
+		"$-1\r\n",
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+		"*-1\r\n",
+		"*2\r\n*0\r\n*1\r\n:1\r\n",
+		"GET key\r\n",
+		"SET key \"hello \\x41\"\r\n",
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d := NewDecoderSize(bytes.NewReader(b), 1024)
+		d.MaxReplyBytes = 1024 * 1024
+		for {
+			r, err := d.Decode()
+			if err != nil {
+				return
+			}
+			p, err := EncodeToBytes(r)
+			assert.MustNoError(err)
+			x, err := DecodeFromBytes(p)
+			assert.MustNoError(err)
+			q, err := EncodeToBytes(x)
+			assert.MustNoError(err)
+			assert.Must(bytes.Equal(p, q))
+		}
+	})
+}
+
+type trickleReader struct {
+	b     []byte
+	delay time.Duration
+}
+
+func (r *trickleReader) Read(b []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	b[0], r.b = r.b[0], r.b[1:]
+	return 1, nil
+}
+
+func TestDecodeDeadline(t *testing.T) {
+	const s = "$10\r\n0123456789\r\n"
+
+	d := NewDecoderSize(&trickleReader{b: []byte(s), delay: time.Millisecond}, 1024)
+	d.SetDeadline(time.Now().Add(time.Second * 5))
+	r, err := d.Decode()
+	assert.MustNoError(err)
+	assert.Must(string(r.Value) == "0123456789")
+
+	d = NewDecoderSize(&trickleReader{b: []byte(s), delay: time.Millisecond * 10}, 1024)
+	d.SetDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrDecodeDeadline))
+	assert.Must(IsTimeout(err))
+
+	d.SetDeadline(time.Time{})
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrDecodeDeadline))
+}
+
+func TestDecodeVerbatim(t *testing.T) {
+	r, err := DecodeFromBytes([]byte("=15\r\ntxt:Some string\r\n"))
+	assert.MustNoError(err)
+	assert.Must(r.IsVerbatim())
+	format, text := r.Verbatim()
+	assert.Must(format == "txt" && string(text) == "Some string")
+
+	b, err := EncodeToBytes(r)
+	assert.MustNoError(err)
+	assert.Must(string(b) == "=15\r\ntxt:Some string\r\n")
+
+	r, err = DecodeFromBytes([]byte("*1\r\n=4\r\nmkd:\r\n"))
+	assert.MustNoError(err)
+	format, text = r.Array[0].Verbatim()
+	assert.Must(format == "mkd" && len(text) == 0)
+
+	for _, s := range []string{"=3\r\ntxt\r\n", "=0\r\n\r\n", "=5\r\ntxt-x\r\n"} {
+		_, err := DecodeFromBytes([]byte(s))
+		assert.Must(errors.Equal(err, ErrBadRespVerbatim))
+	}
+	_, err = DecodeFromBytes([]byte("=-1\r\n"))
+	assert.Must(errors.Equal(err, ErrBadRespBytesLen))
+}
+
+func TestDecodeDouble(t *testing.T) {
+	for s, expect := range map[string]float64{
+		"1.23": 1.23, "-0.5": -0.5, "10": 10, "1e-3": 0.001, "+2.5E2": 250,
+		"inf": math.Inf(1), "+inf": math.Inf(1), "-inf": math.Inf(-1),
+	} {
+		r, err := DecodeFromBytes([]byte("," + s + "\r\n"))
+		assert.MustNoError(err)
+		assert.Must(r.IsDouble())
+		f, err := r.Float()
+		assert.MustNoError(err)
+		assert.Must(f == expect)
+
+		b, err := EncodeToBytes(r)
+		assert.MustNoError(err)
+		assert.Must(string(b) == ","+s+"\r\n")
+	}
+
+	r, err := DecodeFromBytes([]byte(",nan\r\n"))
+	assert.MustNoError(err)
+	f, err := r.Float()
+	assert.Must(err == nil && math.IsNaN(f))
+
+	for _, s := range []string{"", "abc", "1.2.3", "Inf", "infinity", "NaN", "0x1p-2", "1_0", "--1", "1e"} {
+		_, err := (&Resp{Type: TypeDouble, Value: []byte(s)}).Float()
+		assert.Must(errors.Equal(err, ErrBadRespDouble))
+	}
+
+	f, err = NewBulkBytes([]byte("-inf")).Float()
+	assert.Must(err == nil && math.IsInf(f, -1))
+	_, err = NewInt([]byte("1")).Float()
+	assert.Must(err != nil)
+}
+
+func TestDecodeOnBulk(t *testing.T) {
+	var bulks []string
+	d := NewDecoderSize(bytes.NewReader([]byte("*3\r\n$3\r\nfoo\r\n$-1\r\n$0\r\n\r\n$3\r\nbar\r\n=7\r\ntxt:baz\r\n+OK\r\n")), 1024)
+	d.OnBulk = func(b []byte) {
+		bulks = append(bulks, string(b))
+	}
+	for i := 0; i < 4; i++ {
+		_, err := d.Decode()
+		assert.MustNoError(err)
+	}
+	assert.Must(len(bulks) == 4)
+	assert.Must(bulks[0] == "foo" && bulks[1] == "" && bulks[2] == "bar" && bulks[3] == "txt:baz")
+}
+
+func TestDecoderReset(t *testing.T) {
+	d := NewDecoderSize(bytes.NewReader([]byte("$3\r\nfooX\r\n")), 1024)
+	d.MaxBulkLen = 16
+	_, err := d.Decode()
+	assert.Must(errors.Equal(err, ErrBadRespCRLFEnd))
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrBadRespCRLFEnd))
+
+	br := d.Reader
+	d.Reset(bytes.NewReader([]byte("$3\r\nbar\r\n$17\r\n")))
+	assert.Must(d.Reader == br && d.Offset() == 0)
+	r, err := d.Decode()
+	assert.MustNoError(err)
+	assert.Must(string(r.Value) == "bar")
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrBadRespBytesLen))
+
+	d.Reset(bufio.NewReader(bytes.NewReader([]byte(":1\r\n"))))
+	r, err = d.Decode()
+	assert.MustNoError(err)
+	assert.Must(r.IsInt() && string(r.Value) == "1")
+}
+
+func TestDecodeArrayIter(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("*3\r\n$3\r\nfoo\r\n*2\r\n:1\r\n:2\r\n+OK\r\n")
+	b.WriteString("*3\r\n:1\r\n*1\r\n:2\r\n$3\r\nbar\r\n")
+	b.WriteString("+OK\r\n*-1\r\n*0\r\n*2\r\n:1\r\n$3\r\nfo")
+	d := NewDecoderSize(&b, 1024)
+
+	n, next, err := d.DecodeArrayIter()
+	assert.MustNoError(err)
+	assert.Must(n == 3)
+	var elems []string
+	for {
+		r, ok, err := next()
+		assert.MustNoError(err)
+		if !ok {
+			break
+		}
+		elems = append(elems, r.String())
+	}
+	assert.Must(strings.Join(elems, ", ") == `"foo", *2 [(integer) 1 (integer) 2], OK`)
+
+	// the elements left are skipped by the next decode
+	n, next, err = d.DecodeArrayIter()
+	assert.MustNoError(err)
+	assert.Must(n == 3)
+	r, ok, err := next()
+	assert.MustNoError(err)
+	assert.Must(ok && string(r.Value) == "1")
+
+	_, _, err = d.DecodeArrayIter()
+	assert.Must(errors.Equal(err, ErrNotArray))
+	r, err = d.Decode()
+	assert.MustNoError(err)
+	assert.Must(r.IsString() && string(r.Value) == "OK")
+
+	for _, expect := range []int64{-1, 0} {
+		n, next, err = d.DecodeArrayIter()
+		assert.MustNoError(err)
+		assert.Must(n == expect)
+		_, ok, err = next()
+		assert.Must(!ok && err == nil)
+	}
+
+	n, next, err = d.DecodeArrayIter()
+	assert.MustNoError(err)
+	assert.Must(n == 2)
+	_, ok, err = next()
+	assert.Must(ok && err == nil)
+	_, ok, err = next()
+	assert.Must(!ok && errors.Equal(err, ErrIncompleteReply))
+	_, ok, err = next()
+	assert.Must(!ok && errors.Equal(err, ErrIncompleteReply))
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrIncompleteReply))
+}
+
+func TestDecodeKeepRaw(t *testing.T) {
+	replies := []string{
+		"+OK\r\n",
+		"$-1\r\n",
+		"*3\r\n$3\r\nfoo\r\n*1\r\n:1\r\n=8\r\ntxt:abcd\r\n",
+		"GET  key\r\n",
+		"$16\r\n0123456789abcdef\r\n",
+	}
+	d := NewDecoderSize(bytes.NewReader([]byte(strings.Join(replies, ""))), 16)
+	d.KeepRaw = true
+	d.StreamBulkLen = 16
+	for _, s := range replies[:3] {
+		r, err := d.Decode()
+		assert.MustNoError(err)
+		assert.Must(string(r.Raw) == s)
+		assert.Must(r.Array == nil || r.Array[0].Raw == nil)
+	}
+	r := &Resp{}
+	assert.MustNoError(d.DecodeInto(r))
+	assert.Must(string(r.Raw) == replies[3])
+	assert.Must(string(DupResp(r).Raw) == replies[3])
+
+	assert.MustNoError(d.DecodeInto(r))
+	assert.Must(d.Stream() != nil && r.Raw == nil)
+
+	d = NewDecoderSize(bytes.NewReader([]byte(replies[0])), 16)
+	x, err := d.Decode()
+	assert.MustNoError(err)
+	assert.Must(x.Raw == nil)
+}
+
+type endlessReader struct {
+	n int64
+}
+
+func (r *endlessReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'x'
+	}
+	r.n += int64(len(b))
+	return len(b), nil
+}
+
+func TestDecodeLineTooLong(t *testing.T) {
+	r := &endlessReader{}
+	d := NewDecoderSize(r, 1024)
+	d.MaxLineLen = 1024 * 16
+	_, err := d.Decode()
+	assert.Must(errors.Equal(err, ErrLineTooLong))
+	assert.Must(r.n <= d.MaxLineLen+1024)
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrLineTooLong))
+
+	s := "+" + string(bytes.Repeat([]byte("x"), MaxLineBytesLen-2)) + "\r\n"
+	resp, err := DecodeFromBytes([]byte(s))
+	assert.MustNoError(err)
+	assert.Must(len(resp.Value) == MaxLineBytesLen-2)
+	_, err = DecodeFromBytes([]byte("+x" + s[1:]))
+	assert.Must(errors.Equal(err, ErrLineTooLong))
+}
+
+func TestDecodePush(t *testing.T) {
+	s := ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$5\r\nhello\r\n"
+	r, err := DecodeFromBytes([]byte(s))
+	assert.MustNoError(err)
+	assert.Must(r.IsPush() && !r.IsArray() && len(r.Array) == 3)
+	assert.Must(r.String() == `>3 ["message" "ch" "hello"]`)
+
+	b, err := EncodeToBytes(r)
+	assert.MustNoError(err)
+	assert.Must(string(b) == s)
+}
@@ -82,6 +82,38 @@ func (e *Encoder) Encode(r *Resp, flush bool) error {
 	return err
 }
 
+// EncodeBulkStream relays a bulk streamed by a decoder, see
+// Decoder.Stream, reading all that is left of it.
+func (e *Encoder) EncodeBulkStream(s *BulkReader, flush bool) error {
+	if e.Err != nil {
+		return e.Err
+	}
+	err := e.encodeBulkStream(s)
+	if err == nil && flush {
+		err = errors.Trace(e.Flush())
+	}
+	if err != nil {
+		e.Err = err
+	}
+	return err
+}
+
+// EncodeMultiBulk writes args as an array of bulks, the same bytes as
+// encoding them with NewArray/NewBulkBytes, without building any Resp.
+func (e *Encoder) EncodeMultiBulk(args [][]byte, flush bool) error {
+	if e.Err != nil {
+		return e.Err
+	}
+	err := e.encodeMultiBulk(args)
+	if err == nil && flush {
+		err = errors.Trace(e.Flush())
+	}
+	if err != nil {
+		e.Err = err
+	}
+	return err
+}
+
 func Encode(bw *bufio.Writer, r *Resp, flush bool) error {
 	return NewEncoder(bw).Encode(r, flush)
 }
@@ -92,6 +124,10 @@ func EncodeToBytes(r *Resp) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+func EncodeMultiBulkToBytes(multi []*Resp) ([]byte, error) {
+	return EncodeToBytes(NewArray(multi))
+}
+
 func (e *Encoder) encodeResp(r *Resp) error {
 	if err := e.WriteByte(byte(r.Type)); err != nil {
 		return errors.Trace(err)
@@ -99,11 +135,11 @@ func (e *Encoder) encodeResp(r *Resp) error {
 	switch r.Type {
 	default:
 		return errors.Errorf("bad resp type %s", r.Type)
-	case TypeString, TypeError, TypeInt:
+	case TypeString, TypeError, TypeInt, TypeDouble:
 		return e.encodeTextBytes(r.Value)
-	case TypeBulkBytes:
+	case TypeBulkBytes, TypeVerbatim:
 		return e.encodeBulkBytes(r.Value)
-	case TypeArray:
+	case TypeArray, TypePush:
 		return e.encodeArray(r.Array)
 	}
 }
@@ -143,6 +179,42 @@ func (e *Encoder) encodeBulkBytes(b []byte) error {
 	}
 }
 
+func (e *Encoder) encodeBulkStream(s *BulkReader) error {
+	if err := e.WriteByte(byte(TypeBulkBytes)); err != nil {
+		return errors.Trace(err)
+	}
+	if err := e.encodeInt(s.Size()); err != nil {
+		return err
+	}
+	if n, err := io.Copy(e.Writer, s); err != nil {
+		return errors.Trace(err)
+	} else if n != s.Size() {
+		return errors.Trace(io.ErrShortWrite)
+	}
+	if _, err := e.WriteString("\r\n"); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (e *Encoder) encodeMultiBulk(args [][]byte) error {
+	if err := e.WriteByte(byte(TypeArray)); err != nil {
+		return errors.Trace(err)
+	}
+	if err := e.encodeInt(int64(len(args))); err != nil {
+		return err
+	}
+	for _, b := range args {
+		if err := e.WriteByte(byte(TypeBulkBytes)); err != nil {
+			return errors.Trace(err)
+		}
+		if err := e.encodeBulkBytes(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Encoder) encodeArray(a []*Resp) error {
 	if a == nil {
 		return e.encodeInt(-1)
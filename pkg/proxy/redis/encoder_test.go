@@ -6,6 +6,7 @@ package redis
 import (
 	"bytes"
 	"math"
+	"math/rand"
 	"strconv"
 	"testing"
 
@@ -79,6 +80,104 @@ func TestEncodeArray(t *testing.T) {
 	testEncodeAndCheck(t, resp, []byte("*3\r\n:0\r\n$-1\r\n$4\r\ntest\r\n"))
 }
 
+func TestEncodeBulkStream(t *testing.T) {
+	input := "$12\r\nhelloworld!!\r\n:1\r\n"
+	d := NewDecoderSize(bytes.NewReader([]byte(input)), 16)
+	d.StreamBulkLen = 1
+	var b = &bytes.Buffer{}
+	e := NewEncoderSize(b, 16)
+	for i := 0; i < 2; i++ {
+		resp, err := d.Decode()
+		assert.MustNoError(err)
+		if s := d.Stream(); s != nil {
+			assert.MustNoError(e.EncodeBulkStream(s, true))
+		} else {
+			assert.MustNoError(e.Encode(resp, true))
+		}
+	}
+	assert.Must(b.String() == "$12\r\nhelloworld!!\r\n:1\r\n")
+}
+
+func TestEncodeMultiBulkToBytes(t *testing.T) {
+	b, err := EncodeMultiBulkToBytes([]*Resp{
+		NewBulkBytes([]byte("GET")),
+		NewBulkBytes([]byte("key")),
+	})
+	assert.MustNoError(err)
+	assert.Must(string(b) == "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+}
+
+func TestEncodeMultiBulk(t *testing.T) {
+	for _, args := range [][][]byte{
+		{},
+		{[]byte("PING")},
+		{[]byte("AUTH"), []byte("codis"), []byte("foobar")},
+		{[]byte("SET"), []byte("key"), []byte{}},
+	} {
+		var multi = []*Resp{}
+		for _, b := range args {
+			multi = append(multi, NewBulkBytes(b))
+		}
+		expect, err := EncodeMultiBulkToBytes(multi)
+		assert.MustNoError(err)
+
+		var b = &bytes.Buffer{}
+		assert.MustNoError(NewEncoderSize(b, 1024).EncodeMultiBulk(args, true))
+		assert.Must(bytes.Equal(b.Bytes(), expect))
+	}
+}
+
+func newRandomResp(r *rand.Rand, depth int) *Resp {
+	value := func() []byte {
+		b := make([]byte, r.Intn(32))
+		r.Read(b)
+		return b
+	}
+	text := func() []byte {
+		b := make([]byte, r.Intn(32))
+		for i := range b {
+			b[i] = byte('a' + r.Intn(26))
+		}
+		return b
+	}
+	switch n := r.Intn(6); {
+	case n == 0:
+		return NewString(text())
+	case n == 1:
+		return NewError(text())
+	case n == 2:
+		return NewInt([]byte(strconv.Itoa(r.Int() - r.Int())))
+	case n == 3 || depth >= 3:
+		if r.Intn(8) == 0 {
+			return NewBulkBytes(nil)
+		}
+		return NewBulkBytes(value())
+	default:
+		if r.Intn(8) == 0 {
+			return NewArray(nil)
+		}
+		a := make([]*Resp, r.Intn(8))
+		for i := range a {
+			a[i] = newRandomResp(r, depth+1)
+		}
+		return NewArray(a)
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		resp := newRandomResp(r, 0)
+		b, err := EncodeToBytes(resp)
+		assert.MustNoError(err)
+		x, err := DecodeFromBytes(b)
+		assert.MustNoError(err)
+		p, err := EncodeToBytes(x)
+		assert.MustNoError(err)
+		assert.Must(bytes.Equal(b, p))
+	}
+}
+
 func testEncodeAndCheck(t *testing.T, resp *Resp, expect []byte) {
 	b, err := EncodeToBytes(resp)
 	assert.MustNoError(err)
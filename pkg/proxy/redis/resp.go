@@ -3,7 +3,14 @@
 
 package redis
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
 
 type RespType byte
 
@@ -13,6 +20,9 @@ const (
 	TypeInt       RespType = ':'
 	TypeBulkBytes RespType = '$'
 	TypeArray     RespType = '*'
+	TypeVerbatim  RespType = '='
+	TypeDouble    RespType = ','
+	TypePush      RespType = '>'
 )
 
 func (t RespType) String() string {
@@ -27,6 +37,12 @@ func (t RespType) String() string {
 		return "<bulkbytes>"
 	case TypeArray:
 		return "<array>"
+	case TypeVerbatim:
+		return "<verbatim>"
+	case TypeDouble:
+		return "<double>"
+	case TypePush:
+		return "<push>"
 	default:
 		return fmt.Sprintf("<unknown-0x%02x>", byte(t))
 	}
@@ -37,6 +53,10 @@ type Resp struct {
 
 	Value []byte
 	Array []*Resp
+
+	// Raw holds the exact bytes a top-level reply was decoded from, see
+	// Decoder.KeepRaw. It is not used by the encoder.
+	Raw []byte
 }
 
 func (r *Resp) IsString() bool {
@@ -59,6 +79,63 @@ func (r *Resp) IsArray() bool {
 	return r.Type == TypeArray
 }
 
+func (r *Resp) IsVerbatim() bool {
+	return r.Type == TypeVerbatim
+}
+
+// Verbatim splits the value of a verbatim string into its 3 characters
+// format, e.g. txt or mkd, and the text itself.
+func (r *Resp) Verbatim() (format string, text []byte) {
+	if r.Type != TypeVerbatim || len(r.Value) < 4 {
+		return "", nil
+	}
+	return string(r.Value[:3]), r.Value[4:]
+}
+
+func (r *Resp) IsDouble() bool {
+	return r.Type == TypeDouble
+}
+
+// IsPush tells whether r is a RESP3 push, i.e. data sent by the server
+// on its own, like pub/sub messages or client tracking invalidations,
+// rather than a reply to a command. Its elements are in Array.
+func (r *Resp) IsPush() bool {
+	return r.Type == TypePush
+}
+
+var ErrBadRespDouble = errors.New("bad resp double")
+
+// Float parses the value of a double, or of a bulk holding one like the
+// scores of sorted sets in RESP2. Besides numbers, inf, -inf and nan are
+// accepted, as sent by redis for infinite and undefined values.
+func (r *Resp) Float() (float64, error) {
+	if r.Type != TypeDouble && r.Type != TypeBulkBytes {
+		return 0, errors.Errorf("resp %s is not a double", r.Type)
+	}
+	switch string(r.Value) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "-nan":
+		return math.NaN(), nil
+	}
+	// strconv also takes hex, infinity and such, which redis never sends
+	for _, c := range r.Value {
+		switch {
+		case c >= '0' && c <= '9':
+		case c == '+' || c == '-' || c == '.' || c == 'e' || c == 'E':
+		default:
+			return 0, errors.Trace(ErrBadRespDouble)
+		}
+	}
+	f, err := strconv.ParseFloat(string(r.Value), 64)
+	if err != nil {
+		return 0, errors.Trace(ErrBadRespDouble)
+	}
+	return f, nil
+}
+
 func NewString(value []byte) *Resp {
 	return &Resp{
 		Type:  TypeString,
@@ -80,6 +157,11 @@ func NewInt(value []byte) *Resp {
 	}
 }
 
+// NewInteger is NewInt for a value that is not formatted yet.
+func NewInteger(n int64) *Resp {
+	return NewInt([]byte(itoa(n)))
+}
+
 func NewBulkBytes(value []byte) *Resp {
 	return &Resp{
 		Type:  TypeBulkBytes,
@@ -87,6 +169,11 @@ func NewBulkBytes(value []byte) *Resp {
 	}
 }
 
+// NewNil returns a nil bulk, the reply to e.g. a GET of a missing key.
+func NewNil() *Resp {
+	return NewBulkBytes(nil)
+}
+
 func NewArray(array []*Resp) *Resp {
 	return &Resp{
 		Type:  TypeArray,
@@ -99,3 +186,119 @@ func (r *Resp) Append(x *Resp) {
 		r.Array = append(r.Array, x)
 	}
 }
+
+// DupResp deep-copies r into freshly allocated memory, so the copy stays
+// valid whatever happens to r afterwards, e.g. after ReleaseResp.
+func DupResp(r *Resp) *Resp {
+	if r == nil {
+		return nil
+	}
+	x := &Resp{Type: r.Type}
+	if r.Value != nil {
+		x.Value = append([]byte{}, r.Value...)
+	}
+	if r.Raw != nil {
+		x.Raw = append([]byte{}, r.Raw...)
+	}
+	if r.Array != nil {
+		x.Array = make([]*Resp, len(r.Array))
+		for i, a := range r.Array {
+			x.Array[i] = DupResp(a)
+		}
+	}
+	return x
+}
+
+// RespEqual tells whether a and b are the same reply: same type, same
+// value and, recursively, equal array elements. A nil bulk or array is
+// not equal to an empty one.
+func RespEqual(a, b *Resp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type != b.Type {
+		return false
+	}
+	if (a.Value == nil) != (b.Value == nil) || !bytes.Equal(a.Value, b.Value) {
+		return false
+	}
+	if (a.Array == nil) != (b.Array == nil) || len(a.Array) != len(b.Array) {
+		return false
+	}
+	for i := range a.Array {
+		if !RespEqual(a.Array[i], b.Array[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	maxFormatDepth    = 4
+	maxFormatElements = 16
+	maxFormatBytes    = 64
+)
+
+// String renders r the way redis-cli does, compactly and in a single
+// line, e.g. *2 ["GET" "key"]. Long bulks, large and deeply nested
+// arrays are truncated.
+func (r *Resp) String() string {
+	var b bytes.Buffer
+	r.format(&b, 0)
+	return b.String()
+}
+
+func (r *Resp) format(b *bytes.Buffer, depth int) {
+	if r == nil {
+		b.WriteString("(nil)")
+		return
+	}
+	switch r.Type {
+	case TypeString:
+		b.Write(r.Value)
+	case TypeError:
+		b.WriteString("(error) ")
+		b.Write(r.Value)
+	case TypeInt:
+		b.WriteString("(integer) ")
+		b.Write(r.Value)
+	case TypeDouble:
+		b.WriteString("(double) ")
+		b.Write(r.Value)
+	case TypeBulkBytes, TypeVerbatim:
+		switch {
+		case r.Value == nil:
+			b.WriteString("(nil)")
+		case len(r.Value) > maxFormatBytes:
+			b.WriteString(strconv.Quote(string(r.Value[:maxFormatBytes])))
+			fmt.Fprintf(b, "... (%d bytes)", len(r.Value))
+		default:
+			b.WriteString(strconv.Quote(string(r.Value)))
+		}
+	case TypeArray, TypePush:
+		if r.Array == nil {
+			b.WriteString("(nil)")
+			return
+		}
+		fmt.Fprintf(b, "%c%d [", r.Type, len(r.Array))
+		if depth >= maxFormatDepth {
+			if len(r.Array) != 0 {
+				b.WriteString("...")
+			}
+		} else {
+			for i, x := range r.Array {
+				if i != 0 {
+					b.WriteByte(' ')
+				}
+				if i == maxFormatElements {
+					fmt.Fprintf(b, "... (%d more)", len(r.Array)-i)
+					break
+				}
+				x.format(b, depth+1)
+			}
+		}
+		b.WriteByte(']')
+	default:
+		b.WriteString(r.Type.String())
+	}
+}
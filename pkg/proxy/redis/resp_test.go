@@ -0,0 +1,133 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package redis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestRespString(t *testing.T) {
+	var nested = NewArray([]*Resp{NewInt([]byte("1"))})
+	for i := 0; i < 5; i++ {
+		nested = NewArray([]*Resp{nested})
+	}
+	var large = NewArray(nil)
+	for i := 0; i < 20; i++ {
+		large.Append(NewInt([]byte("0")))
+	}
+	test := map[string]*Resp{
+		"OK":                           NewString([]byte("OK")),
+		"(error) ERR unknown":          NewError([]byte("ERR unknown")),
+		"(integer) 42":                 NewInt([]byte("42")),
+		`"hello\r\nworld"`:             NewBulkBytes([]byte("hello\r\nworld")),
+		"(nil)":                        NewBulkBytes(nil),
+		`*2 ["GET" "key"]`:             NewArray([]*Resp{NewBulkBytes([]byte("GET")), NewBulkBytes([]byte("key"))}),
+		"*0 []":                        NewArray([]*Resp{}),
+		"*2 [(nil) *1 [(integer) 1]]":  NewArray([]*Resp{NewBulkBytes(nil), NewArray([]*Resp{NewInt([]byte("1"))})}),
+		"*1 [*1 [*1 [*1 [*1 [...]]]]]": nested,
+		"*20 [" + strings.Repeat("(integer) 0 ", 16) + "... (4 more)]": large,
+	}
+	for s, r := range test {
+		assert.Must(r.String() == s)
+	}
+
+	var r *Resp
+	assert.Must(r.String() == "(nil)")
+
+	s := NewBulkBytes(bytes.Repeat([]byte("x"), 100)).String()
+	assert.Must(s == `"`+strings.Repeat("x", 64)+`"... (100 bytes)`)
+}
+
+func TestDupResp(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("*3\r\n$3\r\nfoo\r\n*1\r\n:1\r\n$-1\r\n")
+	b.WriteString("*3\r\n$3\r\nbar\r\n*1\r\n:2\r\n$0\r\n\r\n")
+	d := NewDecoderSize(&b, 16)
+
+	r := &Resp{}
+	assert.MustNoError(d.DecodeInto(r))
+	x := DupResp(r)
+	expect, err := EncodeToBytes(r)
+	assert.MustNoError(err)
+
+	// the nodes of r are recycled by the next decode
+	ReleaseResp(r)
+	r = respPool.Get().(*Resp)
+	assert.MustNoError(d.DecodeInto(r))
+	assert.Must(string(r.Array[0].Value) == "bar")
+
+	p, err := EncodeToBytes(x)
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(p, expect))
+	assert.Must(x.Array[2].Value == nil)
+
+	assert.Must(DupResp(nil) == nil)
+	assert.Must(DupResp(NewBulkBytes([]byte{})).Value != nil)
+	assert.Must(DupResp(NewArray([]*Resp{})).Array != nil)
+}
+
+func TestRespEqual(t *testing.T) {
+	decode := func(s string) *Resp {
+		r, err := DecodeFromBytes([]byte(s))
+		assert.MustNoError(err)
+		return r
+	}
+	var tests = []struct {
+		a, b  string
+		equal bool
+	}{
+		{"$-1\r\n", "$-1\r\n", true},
+		{"$-1\r\n", "$0\r\n\r\n", false},
+		{"*0\r\n", "*0\r\n", true},
+		{"*0\r\n", "*-1\r\n", false},
+		{"+OK\r\n", "$2\r\nOK\r\n", false},
+		{":1\r\n", ":2\r\n", false},
+		{"*2\r\n*1\r\n*1\r\n$1\r\na\r\n*0\r\n", "*2\r\n*1\r\n*1\r\n$1\r\na\r\n*0\r\n", true},
+		{"*2\r\n*1\r\n*1\r\n$1\r\na\r\n*0\r\n", "*2\r\n*1\r\n*1\r\n$1\r\nb\r\n*0\r\n", false},
+		{"*2\r\n*1\r\n*1\r\n$1\r\na\r\n*0\r\n", "*2\r\n*1\r\n*1\r\n$1\r\na\r\n*-1\r\n", false},
+		{"*1\r\n:1\r\n", "*2\r\n:1\r\n:1\r\n", false},
+	}
+	for _, tt := range tests {
+		a, b := decode(tt.a), decode(tt.b)
+		assert.Must(RespEqual(a, b) == tt.equal)
+		assert.Must(RespEqual(b, a) == tt.equal)
+		assert.Must(RespEqual(a, DupResp(a)))
+	}
+	assert.Must(RespEqual(nil, nil))
+	assert.Must(!RespEqual(nil, NewArray(nil)))
+
+	a, b := decode("*3\r\n$3\r\nfoo\r\n:1\r\n*1\r\n$0\r\n\r\n"), decode("*3\r\n$3\r\nfoo\r\n:1\r\n*1\r\n$0\r\n\r\n")
+	n := testing.AllocsPerRun(100, func() {
+		RespEqual(a, b)
+	})
+	assert.Must(n == 0)
+}
+
+func TestRespBuilders(t *testing.T) {
+	test := map[string]*Resp{
+		"+OK\r\n":             NewString([]byte("OK")),
+		"-ERR unknown\r\n":    NewError([]byte("ERR unknown")),
+		":42\r\n":             NewInt([]byte("42")),
+		":-1\r\n":             NewInteger(-1),
+		":1234567890123\r\n":  NewInteger(1234567890123),
+		"$3\r\nfoo\r\n":       NewBulkBytes([]byte("foo")),
+		"$-1\r\n":             NewNil(),
+		"*0\r\n":              NewArray([]*Resp{}),
+		"*2\r\n:1\r\n$-1\r\n": NewArray([]*Resp{NewInteger(1), NewNil()}),
+	}
+	for s, r := range test {
+		b, err := EncodeToBytes(r)
+		assert.MustNoError(err)
+		assert.Must(string(b) == s)
+		x, err := DecodeFromBytes(b)
+		assert.MustNoError(err)
+		assert.Must(RespEqual(x, r))
+	}
+	assert.Must(NewNil().IsBulkBytes() && NewNil().Value == nil)
+	assert.Must(NewInteger(7).IsInt())
+}
@@ -4,28 +4,79 @@
 package router
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
 
 type BackendConn struct {
 	addr string
-	auth string
 	stop sync.Once
 
+	// mu guards input against being closed while pushing
+	mu     sync.RWMutex
+	closed atomic2.Bool
+
+	done   chan struct{}
+	wait   sync.WaitGroup
+	sock   *redis.Conn
+	sockmu sync.Mutex
+
+	// reset is the last sock closed by Reconnect
+	reset     *redis.Conn
+	reconnect chan struct{}
+
+	config *Config
+
 	input chan *Request
+
+	retry struct {
+		fails int
+		limit int
+		delay *DelayExp2
+
+		// replied is set by the reader once a connection got a reply,
+		// failures in a row are only counted from then on.
+		replied atomic2.Bool
+	}
+
+	breaker *CircuitBreaker
+
+	blocked map[string]bool
+
+	stats BackendStats
+
+	inflight atomic2.Int64
+
+	failed   atomic2.Bool
+	reenable chan struct{}
+
+	readonly atomic2.Bool
 }
 
-func NewBackendConn(addr, auth string) *BackendConn {
+func NewBackendConn(addr string, config *Config) *BackendConn {
 	bc := &BackendConn{
-		addr: addr, auth: auth,
+		addr: addr, config: config,
 		input: make(chan *Request, 1024),
+		done:  make(chan struct{}),
+
+		reenable:  make(chan struct{}, 1),
+		reconnect: make(chan struct{}, 1),
+	}
+	bc.retry.limit = config.retryFailLimit()
+	bc.retry.delay = config.retryDelay()
+	if config.BackendBreakerFailRatio > 0 {
+		bc.breaker = NewCircuitBreaker(config.BackendBreakerFailRatio,
+			config.BackendBreakerMinRequests, config.BackendBreakerCooldown)
 	}
+	bc.blocked = config.blockedCommands()
 	go bc.Run()
 	return bc
 }
@@ -36,6 +87,12 @@ func (bc *BackendConn) Run() {
 		err := bc.loopWriter()
 		if err == nil {
 			break
+		} else if err == errBackendIdle {
+			log.Infof("backend conn [%p] to %s, idle and disconnected", bc, bc.addr)
+			continue
+		} else if err == errBackendReconnect {
+			log.Infof("backend conn [%p] to %s, reconnect", bc, bc.addr)
+			continue
 		} else {
 			for i := len(bc.input); i != 0; i-- {
 				r := <-bc.input
@@ -43,38 +100,233 @@ func (bc *BackendConn) Run() {
 			}
 		}
 		log.WarnErrorf(err, "backend conn [%p] to %s, restart [%d]", bc, bc.addr, k)
-		time.Sleep(time.Millisecond * 50)
+		bc.delayBeforeRetry(err)
 	}
+	bc.wait.Wait()
+	close(bc.done)
 	log.Infof("backend conn [%p] to %s, stop and exit", bc, bc.addr)
 }
 
+func (bc *BackendConn) delayBeforeRetry(err error) {
+	if bc.retry.replied.CompareAndSwap(true, false) {
+		bc.retry.fails = 0
+		bc.retry.delay.Reset()
+	}
+	bc.retry.fails++
+	if max := bc.config.BackendRetryMaxAttempts; max > 0 && bc.retry.fails >= max {
+		bc.waitUntilReenabled(err)
+		return
+	}
+	if bc.retry.fails <= bc.retry.limit {
+		time.Sleep(bc.config.retryMinDelay())
+		return
+	}
+	timeout := bc.retry.delay.After()
+	for {
+		select {
+		case <-timeout:
+			return
+		case r, ok := <-bc.input:
+			if !ok {
+				return
+			}
+			bc.setResponse(r, nil, err)
+		}
+	}
+}
+
+var ErrBackendConnFailed = errors.New("backend conn failed too many times")
+
+// waitUntilReenabled gives up on a backend that failed too many times in
+// a row: requests fail right away without any retry or log, until the
+// backend conn is re-enabled or closed.
+func (bc *BackendConn) waitUntilReenabled(err error) {
+	log.ErrorErrorf(err, "backend conn [%p] to %s, failed %d times in a row, give up until re-enabled",
+		bc, bc.addr, bc.retry.fails)
+	bc.failed.Set(true)
+	for {
+		select {
+		case r, ok := <-bc.input:
+			if !ok {
+				return
+			}
+			bc.setResponse(r, nil, ErrBackendConnFailed)
+		case <-bc.reenable:
+			bc.failed.Set(false)
+			bc.retry.fails = 0
+			bc.retry.delay.Reset()
+			log.Infof("backend conn [%p] to %s, re-enabled", bc, bc.addr)
+			return
+		}
+	}
+}
+
+// Failed reports whether the backend conn gave up after
+// BackendRetryMaxAttempts failures in a row.
+func (bc *BackendConn) Failed() bool {
+	return bc.failed.Get()
+}
+
+// ReadOnly tells whether the backend answered a request with a READONLY
+// error since the conn was last established, e.g. a former master that
+// came back as a replica after a failover. Writes to it keep failing
+// until the slots are moved to the new master.
+func (bc *BackendConn) ReadOnly() bool {
+	return bc.readonly.Get()
+}
+
+// Reenable makes a failed backend conn try to connect again.
+func (bc *BackendConn) Reenable() {
+	if !bc.failed.Get() {
+		return
+	}
+	select {
+	case bc.reenable <- struct{}{}:
+	default:
+	}
+}
+
 func (bc *BackendConn) Addr() string {
 	return bc.addr
 }
 
+// Stats returns the counters of connection establishment, it is updated
+// each time the backend conn (re)connects.
+func (bc *BackendConn) Stats() *BackendStats {
+	return &bc.stats
+}
+
+// Close stops accepting requests, the queued ones are still forwarded.
+// It waits for any PushBack blocked on a full queue to get through.
 func (bc *BackendConn) Close() {
 	bc.stop.Do(func() {
+		bc.mu.Lock()
+		bc.closed.Set(true)
 		close(bc.input)
+		bc.mu.Unlock()
 	})
 }
 
-func (bc *BackendConn) PushBack(r *Request) {
+var ErrBackendCloseTimeout = errors.New("backend conn close timeout")
+
+// CloseGraceful closes the backend conn and waits for all queued and
+// in-flight requests to be answered. After timeout, the connection is
+// reset and whatever is still pending fails.
+func (bc *BackendConn) CloseGraceful(timeout time.Duration) error {
+	bc.Close()
+	select {
+	case <-bc.done:
+		return nil
+	case <-time.After(timeout):
+	}
+	bc.sockmu.Lock()
+	if bc.sock != nil {
+		bc.sock.Close()
+	}
+	bc.sockmu.Unlock()
+	return ErrBackendCloseTimeout
+}
+
+// Reconnect drops the current connection, if any, without closing the
+// backend conn: the next request dials a new one. Requests waiting for a
+// reply on the dropped connection fail with ErrBackendReconnect, queued
+// ones are kept for the new connection.
+func (bc *BackendConn) Reconnect() {
+	if bc.closed.Get() || !bc.connected() {
+		return
+	}
+	select {
+	case bc.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+func (bc *BackendConn) resetSock(c *redis.Conn) {
+	bc.sockmu.Lock()
+	bc.reset = c
+	bc.sockmu.Unlock()
+	c.Close()
+}
+
+func (bc *BackendConn) isReset(c *redis.Conn) bool {
+	bc.sockmu.Lock()
+	defer bc.sockmu.Unlock()
+	return bc.reset == c
+}
+
+func (bc *BackendConn) setSock(c *redis.Conn) {
+	bc.sockmu.Lock()
+	bc.sock = c
+	bc.sockmu.Unlock()
+	bc.readonly.Set(false)
+}
+
+func (bc *BackendConn) connected() bool {
+	bc.sockmu.Lock()
+	defer bc.sockmu.Unlock()
+	return bc.sock != nil
+}
+
+func (bc *BackendConn) clearSock(c *redis.Conn) {
+	bc.sockmu.Lock()
+	if bc.sock == c {
+		bc.sock = nil
+	}
+	bc.sockmu.Unlock()
+}
+
+// PushBack queues r to be forwarded, and fails with ErrBackendConnClosed
+// once the backend conn is closed, in which case r is left untouched.
+// While the queue is full it blocks holding a read lock, so that Close
+// can't close the queue under it: Close, and every PushBack after it,
+// then waits until the writer makes room.
+func (bc *BackendConn) PushBack(r *Request) error {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.closed.Get() {
+		return ErrBackendConnClosed
+	}
 	if r.Wait != nil {
 		r.Wait.Add(1)
 	}
+	if r.Timing != nil {
+		r.Timing.StartTime = time.Now()
+	}
+	if h := bc.config.BackendHooks; h != nil {
+		r.queued = microseconds()
+		if h.OnEnqueue != nil {
+			h.OnEnqueue(bc.addr, r.opstr())
+		}
+	}
+	if bc.breaker != nil && !bc.breaker.Allow() {
+		bc.setResponse(r, nil, ErrBackendCircuitOpen)
+		return nil
+	}
 	bc.input <- r
+	return nil
 }
 
+// KeepAlive sends a PING to a backend conn that has nothing queued and
+// no reply pending, so the probe never waits behind other requests.
 func (bc *BackendConn) KeepAlive() bool {
-	if len(bc.input) != 0 {
+	if len(bc.input) != 0 || bc.inflight.Get() != 0 {
+		return false
+	}
+	if bc.config.BackendIdleTimeout > 0 && !bc.connected() {
 		return false
 	}
 	r := &Request{
 		Resp: redis.NewArray([]*redis.Resp{
 			redis.NewBulkBytes([]byte("PING")),
 		}),
+		keepalive: true,
 	}
 
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.closed.Get() {
+		return false
+	}
 	select {
 	case bc.input <- r:
 		return true
@@ -83,80 +335,493 @@ func (bc *BackendConn) KeepAlive() bool {
 	}
 }
 
-var ErrFailedRequest = errors.New("discard failed request")
+var (
+	ErrBackendConnClosed  = errors.New("use of closed backend conn")
+	ErrBackendPingTimeout = errors.New("backend ping timeout")
+)
+
+func (bc *BackendConn) Ping(timeout time.Duration) error {
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("PING")),
+		}),
+		Wait: &sync.WaitGroup{},
+	}
+	if err := bc.PushBack(r); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.Wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return ErrBackendPingTimeout
+	}
+
+	resp, err := r.Response.Resp, r.Response.Err
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		return ErrRespIsRequired
+	}
+	if !resp.IsString() || string(resp.Value) != "PONG" {
+		return errors.New(fmt.Sprintf("error resp: should be PONG, but got %s", resp))
+	}
+	return nil
+}
+
+var (
+	ErrFailedRequest         = errors.New("discard failed request")
+	ErrBackendRequestTimeout = errors.New("backend request timeout")
+	ErrBackendCircuitOpen    = errors.New("backend circuit breaker is open")
+	ErrCommandBlocked        = errors.New("command is blocked by proxy")
+	ErrCommandRewrite        = errors.New("command rewrite failed")
+	ErrBackendReconnect      = errors.New("backend conn reconnected")
+
+	// ErrBackendUnexpectedReply fails the requests of a connection reset
+	// because the backend sent more than it was asked for. It is caught
+	// when the extra bytes are already buffered as the last reply
+	// outstanding is read, e.g. when both came in one packet, or by the
+	// poll of idle connections every BackendPushPollInterval. An extra
+	// reply that arrives after the next request was sent, before a poll
+	// saw it, still goes unnoticed and is paired with that request.
+	ErrBackendUnexpectedReply = errors.New("backend sent an unexpected reply")
+
+	errBackendIdle      = errors.New("backend conn is idle")
+	errBackendReconnect = errors.New("backend conn asked to reconnect")
+)
+
+// isRefused tells whether err refused a request before it was sent to
+// the backend. The session answers such a request with an error reply
+// and keeps serving the client.
+func isRefused(err error) bool {
+	switch errors.Cause(err) {
+	case ErrCommandBlocked, ErrBackendCircuitOpen, ErrBackendConnFailed:
+		return true
+	}
+	return false
+}
 
 func (bc *BackendConn) loopWriter() error {
 	r, ok := <-bc.input
 	if ok {
 		c, tasks, err := bc.newBackendReader()
 		if err != nil {
+			bc.recordResult(err)
 			return bc.setResponse(r, nil, err)
 		}
 		defer close(tasks)
 
 		p := &FlushPolicy{
 			Encoder:     c.Writer,
-			MaxBuffered: 64,
-			MaxInterval: 300,
+			MaxBuffered: bc.config.flushMaxBuffered(),
+			MaxInterval: int64(bc.config.flushMaxInterval() / time.Microsecond),
+			lastflush:   microseconds(),
 		}
+
+		var limiter *RateLimiter
+		if qps := bc.config.BackendMaxQPS; qps > 0 {
+			limiter = NewRateLimiter(qps)
+		}
+
+		var idle *time.Timer
+		var idlec <-chan time.Time
+		var timeout = bc.config.BackendIdleTimeout
+		if timeout > 0 {
+			idle = time.NewTimer(timeout)
+			idlec = idle.C
+			defer idle.Stop()
+		}
+
+		// requests buffered because of NoFlush are not held back for more
+		// than MaxInterval, even if no request follows
+		flusher := time.NewTimer(time.Hour)
+		flusher.Stop()
+		defer flusher.Stop()
+		var flushc <-chan time.Time
+
 		for ok {
-			var flush = len(bc.input) == 0
-			if bc.canForward(r) {
-				if err := p.Encode(r.Resp, flush); err != nil {
+			if idle != nil && !r.keepalive {
+				if !idle.Stop() {
+					select {
+					case <-idle.C:
+					default:
+					}
+				}
+				idle.Reset(timeout)
+			}
+			var flush = len(bc.input) == 0 && !r.NoFlush
+			if bc.isBlocked(r) {
+				if err := p.Flush(flush); err != nil {
 					return bc.setResponse(r, nil, err)
 				}
-				tasks <- r
-			} else {
+				bc.setResponse(r, nil, ErrCommandBlocked)
+			} else if !bc.canForward(r) {
 				if err := p.Flush(flush); err != nil {
 					return bc.setResponse(r, nil, err)
 				}
 				bc.setResponse(r, nil, ErrFailedRequest)
+			} else if resp, err := bc.rewrite(r); err != nil {
+				if err := p.Flush(flush); err != nil {
+					return bc.setResponse(r, nil, err)
+				}
+				bc.setResponse(r, nil, err)
+			} else {
+				if limiter != nil {
+					if d := limiter.Reserve(time.Now()); d > 0 {
+						// over the rate, let the backend see what is
+						// buffered while later requests wait in input
+						if err := p.Flush(true); err != nil {
+							return bc.setResponse(r, nil, err)
+						}
+						time.Sleep(d)
+					}
+				}
+				// counted before it is written, so that any reply read
+				// while nothing is in flight must be unsolicited
+				bc.inflight.Incr()
+				if err := p.Encode(resp, flush); err != nil {
+					bc.inflight.Decr()
+					return bc.setResponse(r, nil, err)
+				}
+				if r.Timing != nil {
+					r.Timing.SentTime = time.Now()
+				}
+				if bc.config.BackendSlowlogThreshold != 0 || bc.config.BackendHooks != nil {
+					r.sent = microseconds()
+				}
+				if h := bc.config.BackendHooks; h != nil && h.OnEncode != nil {
+					var queued time.Duration
+					if r.queued != 0 {
+						queued = time.Microsecond * time.Duration(r.sent-r.queued)
+					}
+					h.OnEncode(bc.addr, r.opstr(), queued)
+				}
+				select {
+				case tasks <- r:
+				default:
+					// too many requests in flight, make sure the backend
+					// can see the buffered ones before waiting for replies
+					if err := p.Flush(true); err != nil {
+						bc.inflight.Decr()
+						return bc.setResponse(r, nil, err)
+					}
+					tasks <- r
+				}
 			}
 
-			r, ok = <-bc.input
+			if p.nbuffered != 0 && flushc == nil {
+				flusher.Reset(bc.config.flushMaxInterval())
+				flushc = flusher.C
+			} else if p.nbuffered == 0 && flushc != nil {
+				if !flusher.Stop() {
+					select {
+					case <-flusher.C:
+					default:
+					}
+				}
+				flushc = nil
+			}
+			for next := false; !next; {
+				select {
+				case r, ok = <-bc.input:
+					next = true
+				case <-flushc:
+					flushc = nil
+					if err := p.Flush(true); err != nil {
+						return err
+					}
+				case <-idlec:
+					return errBackendIdle
+				case <-bc.reconnect:
+					bc.resetSock(c)
+					return errBackendReconnect
+				}
+			}
 		}
+		p.Flush(true)
 	}
 	return nil
 }
 
+// resolve returns the address to dial for this round, bc.addr itself
+// unless a BackendResolver is configured. Any caching is up to the
+// resolver, and its error fails the round like a failed dial.
+func (bc *BackendConn) resolve() (string, error) {
+	if bc.config.BackendResolver == nil {
+		return bc.addr, nil
+	}
+	addr, err := bc.config.BackendResolver(bc.addr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return addr, nil
+}
+
 func (bc *BackendConn) newBackendReader() (*redis.Conn, chan<- *Request, error) {
-	c, err := redis.DialTimeout(bc.addr, 1024*512, time.Second)
+	start := time.Now()
+	var c *redis.Conn
+	addr, err := bc.resolve()
+	if err == nil {
+		c, err = redis.DialTimeoutSizes(bc.config.BackendSourceAddr, addr,
+			bc.config.decoderBufsize(), DefaultBackendSendBufsize, time.Second)
+	}
+	if err == nil {
+		if err = bc.setSockOpts(c.Sock); err != nil {
+			c.Close()
+		}
+	}
+	bc.stats.Dial.record(time.Since(start), err)
 	if err != nil {
 		return nil, nil, err
 	}
-	c.ReaderTimeout = time.Minute
+	c.ReaderTimeout = backendReadTimeout
 	c.WriterTimeout = time.Minute
 
-	if err := bc.verifyAuth(c); err != nil {
-		c.Close()
-		return nil, nil, err
+	if bc.config.Auth != "" {
+		start = time.Now()
+		err = bc.verifyAuth(c)
+		bc.stats.Auth.record(time.Since(start), err)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	if len(bc.config.BackendWarmupCommands) != 0 {
+		start = time.Now()
+		err = bc.warmup(c)
+		bc.stats.Warmup.record(time.Since(start), err)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
 	}
 
-	tasks := make(chan *Request, 4096)
+	tasks := make(chan *Request, bc.config.maxInflight())
+	bc.setSock(c)
+	select {
+	case <-bc.reconnect:
+		// asked before this connection existed
+	default:
+	}
+	bc.wait.Add(1)
 	go func() {
+		defer bc.wait.Done()
+		defer bc.clearSock(c)
 		defer c.Close()
-		for r := range tasks {
-			resp, err := c.Reader.Decode()
-			bc.setResponse(r, resp, err)
+		var desync, replied bool
+		ticker := time.NewTicker(bc.config.pushPollInterval())
+		defer ticker.Stop()
+		poll := ticker.C
+		for {
+			var r *Request
+			var ok bool
+			select {
+			case r, ok = <-tasks:
+			case <-poll:
+				if desync || bc.isReset(c) {
+					continue
+				}
+				if err := bc.pollIdle(c); err != nil {
+					log.WarnErrorf(err, "backend conn [%p] to %s, poll idle conn failed", bc, bc.addr)
+					desync = errors.Equal(err, ErrBackendUnexpectedReply)
+					c.Close()
+					poll = nil
+				}
+				continue
+			}
+			if !ok {
+				return
+			}
+			c.ReaderTimeout = readTimeout(r)
+			c.Reader.SetDeadline(r.Deadline)
+			resp, err := bc.decodeReply(c)
+			switch {
+			case err == nil:
+			case desync:
+				err = errors.Trace(ErrBackendUnexpectedReply)
+			case bc.isReset(c):
+				err = errors.Trace(ErrBackendReconnect)
+			}
+			if r.Timing != nil {
+				r.Timing.RecvTime = time.Now()
+			}
+			if err != nil && !r.Deadline.IsZero() && redis.IsTimeout(err) {
+				if !time.Now().Before(r.Deadline) {
+					err = errors.Trace(ErrBackendRequestTimeout)
+				}
+			}
+			if r.sent != 0 {
+				usecs := microseconds() - r.sent
+				if bc.config.BackendSlowlogThreshold != 0 {
+					bc.slowlog(r, usecs)
+				}
+				if h := bc.config.BackendHooks; h != nil && h.OnReply != nil {
+					h.OnReply(bc.addr, r.opstr(), time.Microsecond*time.Duration(usecs), err)
+				}
+			}
+			if err == nil && !replied {
+				replied = true
+				bc.retry.replied.Set(true)
+			}
+			if err == nil && isReadOnlyResp(resp) && bc.readonly.CompareAndSwap(false, true) {
+				log.Warnf("backend conn [%p] to %s, backend is read-only", bc, bc.addr)
+			}
+			bc.recordResult(err)
+			bc.inflight.Decr()
+			if err == nil && !bc.canForward(r) {
+				bc.setResponse(r, nil, ErrFailedRequest)
+			} else {
+				bc.setResponse(r, resp, err)
+			}
 			if err != nil {
+				log.WarnErrorf(err, "backend conn [%p] to %s, read reply failed", bc, bc.addr)
 				// close tcp to tell writer we are failed and should quit
 				c.Close()
+			} else if bc.config.BackendPushHandler == nil && !desync && bc.inflight.Get() == 0 && c.Reader.Buffered() != 0 {
+				// more bytes than replies to requests sent, pairing the
+				// next reply with the next request would be wrong; best
+				// effort, see ErrBackendUnexpectedReply
+				log.Warnf("backend conn [%p] to %s, unexpected reply, reset connection", bc, bc.addr)
+				desync = true
+				c.Close()
 			}
 		}
 	}()
 	return c, tasks, nil
 }
 
+// decodeReply decodes the next reply, passing the pushes in front of it
+// to BackendPushHandler, which owns them, or dropping them without one.
+func (bc *BackendConn) decodeReply(c *redis.Conn) (*redis.Resp, error) {
+	for {
+		resp, err := c.Reader.Decode()
+		if err != nil || !resp.IsPush() {
+			return resp, err
+		}
+		if h := bc.config.BackendPushHandler; h != nil {
+			h(resp)
+		}
+	}
+}
+
+// pollIdle reads what the backend sent while no request is outstanding.
+// The writer counts a request as inflight before sending it, so data
+// arriving while the count is still 0 can't be a reply: it must be a push,
+// ErrBackendUnexpectedReply is returned otherwise.
+func (bc *BackendConn) pollIdle(c *redis.Conn) error {
+	c.Reader.SetDeadline(time.Time{})
+	for bc.inflight.Get() == 0 {
+		c.ReaderTimeout = time.Millisecond
+		if _, err := c.Reader.Peek(1); err != nil {
+			if redis.IsTimeout(err) {
+				return nil
+			}
+			return err
+		}
+		if bc.inflight.Get() != 0 {
+			// may be a reply, left to the reader
+			return nil
+		}
+		c.ReaderTimeout = backendReadTimeout
+		resp, err := c.Reader.Decode()
+		if err != nil {
+			return err
+		}
+		if !resp.IsPush() {
+			return errors.Trace(ErrBackendUnexpectedReply)
+		}
+		if h := bc.config.BackendPushHandler; h != nil {
+			h(resp)
+		}
+	}
+	return nil
+}
+
+func (bc *BackendConn) setSockOpts(sock net.Conn) error {
+	tc, ok := sock.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if bc.config.BackendSocketReset {
+		if err := tc.SetLinger(0); err != nil {
+			return errors.Trace(err)
+		}
+	} else if n := bc.config.BackendSocketLinger; n != 0 {
+		if err := tc.SetLinger(n); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if bc.config.BackendDisableNoDelay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func newAuthRequest(user, auth string) [][]byte {
+	args := [][]byte{[]byte("AUTH")}
+	if user != "" {
+		args = append(args, []byte(user))
+	}
+	return append(args, []byte(auth))
+}
+
+var errRespReadOnly = []byte("READONLY")
+
+func isReadOnlyResp(resp *redis.Resp) bool {
+	return resp != nil && resp.IsError() && bytes.HasPrefix(resp.Value, errRespReadOnly)
+}
+
+func (bc *BackendConn) recordResult(err error) {
+	if bc.breaker != nil {
+		bc.breaker.Record(err != nil)
+	}
+}
+
+const backendReadTimeout = time.Minute
+
+// Responses are decoded in the order requests were sent, so a request
+// with a deadline is only waited on after all requests ahead of it have
+// been answered. When its deadline passes the connection is closed, as
+// the late response would otherwise be paired with the next request;
+// the requests queued behind it fail with the same error and the
+// backend conn reconnects on the next round.
+func readTimeout(r *Request) time.Duration {
+	if r.Deadline.IsZero() {
+		return backendReadTimeout
+	}
+	d := r.Deadline.Sub(time.Now())
+	if d <= 0 {
+		return time.Nanosecond
+	}
+	if d > backendReadTimeout {
+		return backendReadTimeout
+	}
+	return d
+}
+
+func (bc *BackendConn) slowlog(r *Request, usecs int64) {
+	threshold := int64(bc.config.BackendSlowlogThreshold / time.Microsecond)
+	if usecs > threshold {
+		log.Warnf("backend conn [%p] to %s, slow command %s, elapsed = %dus",
+			bc, bc.addr, r.opstr(), usecs)
+	}
+}
+
 func (bc *BackendConn) verifyAuth(c *redis.Conn) error {
-	if bc.auth == "" {
+	if bc.config.Auth == "" {
 		return nil
 	}
-	resp := redis.NewArray([]*redis.Resp{
-		redis.NewBulkBytes([]byte("AUTH")),
-		redis.NewBulkBytes([]byte(bc.auth)),
-	})
+	args := newAuthRequest(bc.config.AuthUser, bc.config.Auth)
 
-	if err := c.Writer.Encode(resp, true); err != nil {
+	if err := c.Writer.EncodeMultiBulk(args, true); err != nil {
 		return err
 	}
 
@@ -177,6 +842,79 @@ func (bc *BackendConn) verifyAuth(c *redis.Conn) error {
 	}
 }
 
+func (bc *BackendConn) warmup(c *redis.Conn) error {
+	for _, cmd := range bc.config.BackendWarmupCommands {
+		args, err := redis.SplitInlineArgs(cmd)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if err := c.Writer.EncodeMultiBulk(args, true); err != nil {
+			return err
+		}
+		resp, err := c.Reader.Decode()
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return ErrRespIsRequired
+		}
+		if resp.IsError() {
+			return errors.New(fmt.Sprintf("warmup %s, error resp: %s", cmd, resp.Value))
+		}
+	}
+	return nil
+}
+
+// isBlocked reports whether the command is in BackendBlockedCommands,
+// the name is upper-cased into a stack buffer so the lookup doesn't
+// allocate.
+func (bc *BackendConn) isBlocked(r *Request) bool {
+	if len(bc.blocked) == 0 || r.Resp == nil || len(r.Resp.Array) == 0 {
+		return false
+	}
+	var upper [64]byte
+
+	var op = r.Resp.Array[0].Value
+	if len(op) > len(upper) {
+		return false
+	}
+	for i := 0; i < len(op); i++ {
+		c := op[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper[i] = c
+	}
+	return bc.blocked[string(upper[:len(op)])]
+}
+
+// rewrite returns what to send for r once BackendCommandRewriter has run
+// on it. Keepalive probes are not rewritten. A rewriter that panics or
+// returns an empty command fails that request only.
+func (bc *BackendConn) rewrite(r *Request) (resp *redis.Resp, err error) {
+	fn := bc.config.BackendCommandRewriter
+	if fn == nil || r.keepalive {
+		return r.Resp, nil
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			log.Errorf("backend conn [%p] to %s, command rewriter panic: %v", bc, bc.addr, x)
+			resp, err = nil, errors.Trace(ErrCommandRewrite)
+		}
+	}()
+	multi := fn(r.Resp.Array)
+	switch {
+	case len(multi) == 0:
+		return nil, errors.Trace(ErrCommandRewrite)
+	case len(multi) == len(r.Resp.Array) && &multi[0] == &r.Resp.Array[0]:
+		return r.Resp, nil
+	}
+	return redis.NewArray(multi), nil
+}
+
 func (bc *BackendConn) canForward(r *Request) bool {
 	if r.Failed != nil && r.Failed.Get() {
 		return false
@@ -187,7 +925,7 @@ func (bc *BackendConn) canForward(r *Request) bool {
 
 func (bc *BackendConn) setResponse(r *Request, resp *redis.Resp, err error) error {
 	r.Response.Resp, r.Response.Err = resp, err
-	if err != nil && r.Failed != nil {
+	if err != nil && r.Failed != nil && !isRefused(err) {
 		r.Failed.Set(true)
 	}
 	if r.Wait != nil {
@@ -206,8 +944,8 @@ type SharedBackendConn struct {
 	refcnt int
 }
 
-func NewSharedBackendConn(addr, auth string) *SharedBackendConn {
-	return &SharedBackendConn{BackendConn: NewBackendConn(addr, auth), refcnt: 1}
+func NewSharedBackendConn(addr string, config *Config) *SharedBackendConn {
+	return &SharedBackendConn{BackendConn: NewBackendConn(addr, config), refcnt: 1}
 }
 
 func (s *SharedBackendConn) Close() bool {
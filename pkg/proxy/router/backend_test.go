@@ -4,16 +4,56 @@
 package router
 
 import (
+	"bytes"
+	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 )
 
+// newMockBackend starts a backend that calls handler with every request
+// it reads, on the connection it came in, which is closed once handler
+// returns an error. It is shut down at the end of the test.
+func newMockBackend(t *testing.T, handler func(conn *redis.Conn, req *redis.Resp) error) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				conn := redis.NewConn(c)
+				for {
+					req, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					if err := handler(conn, req); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func replyOK(conn *redis.Conn, req *redis.Resp) error {
+	return conn.Writer.Encode(redis.NewString([]byte("OK")), true)
+}
+
 func TestBackend(t *testing.T) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.MustNoError(err)
@@ -22,7 +62,7 @@ func TestBackend(t *testing.T) {
 	addr := l.Addr().String()
 	reqc := make(chan *Request, 16384)
 	go func() {
-		bc := NewBackendConn(addr, "")
+		bc := NewBackendConn(addr, &Config{})
 		defer bc.Close()
 		defer close(reqc)
 		var resp = redis.NewBulkBytes(make([]byte, 4096))
@@ -58,3 +98,1060 @@ func TestBackend(t *testing.T) {
 	}
 	assert.Must(n == cap(reqc))
 }
+
+func TestBackendAuthRequest(t *testing.T) {
+	encode := func(args [][]byte) string {
+		var b = &bytes.Buffer{}
+		assert.MustNoError(redis.NewEncoderSize(b, 1024).EncodeMultiBulk(args, true))
+		return b.String()
+	}
+	assert.Must(encode(newAuthRequest("", "foobar")) == "*2\r\n$4\r\nAUTH\r\n$6\r\nfoobar\r\n")
+	assert.Must(encode(newAuthRequest("codis", "foobar")) == "*3\r\n$4\r\nAUTH\r\n$5\r\ncodis\r\n$6\r\nfoobar\r\n")
+}
+
+func TestBackendRequestDeadline(t *testing.T) {
+	// the backend never answers
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	r1 := &Request{
+		Resp:     redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("PING"))}),
+		Wait:     &sync.WaitGroup{},
+		Deadline: time.Now().Add(time.Millisecond * 100),
+	}
+	// r2 has no deadline and belongs to another session
+	failed := &atomic2.Bool{}
+	r2 := &Request{
+		Resp:   redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("PING"))}),
+		Wait:   &sync.WaitGroup{},
+		Failed: failed,
+	}
+	bc.PushBack(r1)
+	bc.PushBack(r2)
+
+	r1.Wait.Wait()
+	assert.Must(errors.Equal(r1.Response.Err, ErrBackendRequestTimeout))
+	// the shared connection is closed, so r2 fails as well and its
+	// session is marked failed, which closes the client connection
+	r2.Wait.Wait()
+	assert.Must(r2.Response.Err != nil && !errors.Equal(r2.Response.Err, ErrBackendRequestTimeout))
+	assert.Must(failed.Get())
+}
+
+func TestBackendPing(t *testing.T) {
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		return conn.Writer.Encode(redis.NewString([]byte("PONG")), true)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	assert.MustNoError(bc.Ping(time.Second))
+	bc.Close()
+	assert.Must(bc.Ping(time.Second) == ErrBackendConnClosed)
+}
+
+func TestBackendWarmup(t *testing.T) {
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		return conn.Writer.Encode(redis.NewError([]byte("LOADING")), true)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendWarmupCommands: []string{"PING"},
+	})
+	defer bc.Close()
+
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil && r.Response.Resp == nil)
+}
+
+func TestBackendWarmupArgs(t *testing.T) {
+	recv := make(chan []string, 16)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		var args []string
+		for _, arg := range req.Array {
+			args = append(args, string(arg.Value))
+		}
+		recv <- args
+		return replyOK(conn, req)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendWarmupCommands: []string{`CLIENT SETNAME "codis proxy"`},
+	})
+	defer bc.Close()
+
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	assert.MustNoError(bc.PushBack(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(strings.Join(<-recv, "|") == "CLIENT|SETNAME|codis proxy")
+	assert.Must(strings.Join(<-recv, "|") == "GET")
+}
+
+func TestBackendBlockedCommands(t *testing.T) {
+	recv := make(chan string, 16)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- string(req.Array[0].Value)
+		return replyOK(conn, req)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendBlockedCommands: []string{"flushall", " CONFIG "},
+	})
+	defer bc.Close()
+
+	// a blocked command only fails itself, not the session
+	failed := &atomic2.Bool{}
+	for _, op := range []string{"FLUSHALL", "config", "Config", "GET", "FlushAll", "SET"} {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte(op))}),
+			Wait: &sync.WaitGroup{}, Failed: failed,
+		}
+		bc.PushBack(r)
+		r.Wait.Wait()
+		switch op {
+		case "GET", "SET":
+			assert.MustNoError(r.Response.Err)
+			assert.Must(string(r.Response.Resp.Value) == "OK")
+		default:
+			assert.Must(errors.Equal(r.Response.Err, ErrCommandBlocked))
+		}
+	}
+	assert.Must(<-recv == "GET")
+	assert.Must(<-recv == "SET")
+	assert.Must(len(recv) == 0)
+	assert.Must(!failed.Get())
+}
+
+func BenchmarkBackendIsBlocked(b *testing.B) {
+	bc := &BackendConn{blocked: (&Config{
+		BackendBlockedCommands: []string{"FLUSHALL", "SHUTDOWN", "CONFIG"},
+	}).blockedCommands()}
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("flushall"))}),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !bc.isBlocked(r) {
+			b.Fatal("should be blocked")
+		}
+	}
+}
+
+func TestBackendMaxInflight(t *testing.T) {
+	recv := make(chan *redis.Conn, 64)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- conn
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{BackendMaxInflight: 2})
+	defer bc.Close()
+
+	var reqs []*Request
+	for i := 0; i < 10; i++ {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		bc.PushBack(r)
+		reqs = append(reqs, r)
+	}
+
+	// one being read, two queued for the reader, one blocked in writer
+	time.Sleep(time.Millisecond * 200)
+	assert.Must(len(recv) == 4)
+
+	for i := 0; i < len(reqs); i++ {
+		conn := <-recv
+		resp := redis.NewString([]byte(strconv.Itoa(i)))
+		assert.MustNoError(conn.Writer.Encode(resp, true))
+	}
+	for i, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == strconv.Itoa(i))
+	}
+}
+
+func TestBackendStats(t *testing.T) {
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		return conn.Writer.Encode(redis.NewError([]byte("WRONGPASS")), true)
+	})
+	addr := l.Addr().String()
+
+	bc := NewBackendConn(addr, &Config{Auth: "foobar"})
+	defer bc.Close()
+
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil)
+
+	stats := bc.Stats()
+	assert.Must(stats.Dial.Calls() == 1 && stats.Dial.Fails() == 0)
+	assert.Must(stats.Auth.Calls() == 1 && stats.Auth.Fails() == 1)
+	assert.Must(stats.Warmup.Calls() == 0)
+
+	// nothing listens anymore, dialing fails
+	l.Close()
+	r = &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil)
+	assert.Must(stats.Dial.Calls() == 2 && stats.Dial.Fails() == 1)
+	assert.Must(stats.Auth.Calls() == 1)
+
+	var n int64
+	for _, v := range stats.Dial.Buckets() {
+		n += v
+	}
+	assert.Must(n == 2)
+}
+
+func TestBackendCloseGraceful(t *testing.T) {
+	newServer := func(delay time.Duration) string {
+		l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+			time.Sleep(delay)
+			return replyOK(conn, req)
+		})
+		return l.Addr().String()
+	}
+	newRequests := func(bc *BackendConn, n int) []*Request {
+		var reqs []*Request
+		for i := 0; i < n; i++ {
+			r := &Request{
+				Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+				Wait: &sync.WaitGroup{},
+			}
+			bc.PushBack(r)
+			reqs = append(reqs, r)
+		}
+		return reqs
+	}
+
+	bc := NewBackendConn(newServer(time.Millisecond*20), &Config{})
+	reqs := newRequests(bc, 5)
+	assert.MustNoError(bc.CloseGraceful(time.Second * 5))
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	assert.Must(errors.Equal(bc.PushBack(r), ErrBackendConnClosed))
+	r.Wait.Wait()
+
+	bc = NewBackendConn(newServer(time.Hour), &Config{})
+	reqs = newRequests(bc, 5)
+	time.Sleep(time.Millisecond * 100)
+	err := bc.CloseGraceful(time.Millisecond * 100)
+	assert.Must(errors.Equal(err, ErrBackendCloseTimeout))
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.Must(r.Response.Err != nil)
+	}
+	bc.Close()
+}
+
+func TestBackendPushBackClosed(t *testing.T) {
+	for k := 0; k < 20; k++ {
+		bc := NewBackendConn("127.0.0.1:0", &Config{})
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					r := &Request{
+						Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+						Wait: &sync.WaitGroup{},
+					}
+					if err := bc.PushBack(r); err != nil {
+						assert.Must(errors.Equal(err, ErrBackendConnClosed))
+					}
+					r.Wait.Wait()
+				}
+			}()
+		}
+		bc.Close()
+		wg.Wait()
+		bc.Close()
+	}
+}
+
+func TestBackendIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	accepted := make(chan struct{}, 16)
+	closed := make(chan struct{}, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer func() {
+					c.Close()
+					closed <- struct{}{}
+				}()
+				conn := redis.NewConn(c)
+				for {
+					if _, err := conn.Reader.Decode(); err != nil {
+						return
+					}
+					if err := conn.Writer.Encode(redis.NewString([]byte("OK")), true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendIdleTimeout: time.Millisecond * 100,
+	})
+	defer bc.Close()
+
+	get := func() {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+
+	get()
+	<-accepted
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Millisecond * 30)
+		get()
+	}
+	assert.Must(len(closed) == 0)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		assert.Must(false)
+	}
+	time.Sleep(time.Millisecond * 50)
+	assert.Must(!bc.KeepAlive())
+	time.Sleep(time.Millisecond * 50)
+	assert.Must(len(accepted) == 0)
+
+	get()
+	<-accepted
+}
+
+func TestBackendKeepAliveInflight(t *testing.T) {
+	recv := make(chan *redis.Resp, 16)
+	reply := make(chan struct{})
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- req
+		<-reply
+		return replyOK(conn, req)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	r := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("BLPOP"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	assert.MustNoError(bc.PushBack(r))
+	assert.Must(string((<-recv).Array[0].Value) == "BLPOP")
+
+	for i := 0; i < 10; i++ {
+		assert.Must(!bc.KeepAlive())
+	}
+	reply <- struct{}{}
+	r.Wait.Wait()
+
+	assert.Must(bc.KeepAlive())
+	assert.Must(string((<-recv).Array[0].Value) == "PING")
+	reply <- struct{}{}
+	assert.Must(len(recv) == 0)
+}
+
+func TestBackendHooks(t *testing.T) {
+	l := newMockBackend(t, replyOK)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(s string) {
+		mu.Lock()
+		events = append(events, s)
+		mu.Unlock()
+	}
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendHooks: &BackendHooks{
+			OnEnqueue: func(addr, opstr string) {
+				record("enqueue " + opstr)
+			},
+			OnEncode: func(addr, opstr string, queued time.Duration) {
+				assert.Must(queued >= 0)
+				record("encode " + opstr)
+			},
+			OnReply: func(addr, opstr string, elapsed time.Duration, err error) {
+				assert.Must(elapsed >= 0 && err == nil)
+				record("reply " + opstr)
+			},
+		},
+	})
+	defer bc.Close()
+
+	r := &Request{
+		OpStr: "GET",
+		Resp:  redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("get"))}),
+		Wait:  &sync.WaitGroup{},
+	}
+	assert.MustNoError(bc.PushBack(r))
+	r.Wait.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(len(events) == 3)
+	assert.Must(events[0] == "enqueue GET" && events[1] == "encode GET" && events[2] == "reply GET")
+}
+
+func TestBackendRetryMaxAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	addr := l.Addr().String()
+	l.Close()
+
+	bc := NewBackendConn(addr, &Config{BackendRetryMaxAttempts: 3})
+	defer bc.Close()
+
+	get := func() error {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		return r.Response.Err
+	}
+	for i := 0; i < 3; i++ {
+		err := get()
+		assert.Must(err != nil && !errors.Equal(err, ErrBackendConnFailed))
+	}
+	for i := 0; i < 3; i++ {
+		assert.Must(errors.Equal(get(), ErrBackendConnFailed))
+	}
+	assert.Must(bc.Failed())
+
+	l, err = net.Listen("tcp", addr)
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		assert.MustNoError(err)
+		defer c.Close()
+		conn := redis.NewConn(c)
+		for {
+			if _, err := conn.Reader.Decode(); err != nil {
+				return
+			}
+			if err := conn.Writer.Encode(redis.NewString([]byte("OK")), true); err != nil {
+				return
+			}
+		}
+	}()
+
+	bc.Reenable()
+	for bc.Failed() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.MustNoError(get())
+}
+
+func TestBackendReadOnly(t *testing.T) {
+	replies := []*redis.Resp{
+		redis.NewString([]byte("OK")),
+		redis.NewError([]byte("READONLY You can't write against a read only replica.")),
+	}
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		resp := replies[0]
+		replies = replies[1:]
+		return conn.Writer.Encode(resp, true)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	for _, readonly := range []bool{false, true} {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("SET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(bc.ReadOnly() == readonly)
+	}
+}
+
+func TestBackendDiscardFailedReply(t *testing.T) {
+	recv := make(chan *redis.Conn, 4)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- conn
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	failed := &atomic2.Bool{}
+	r1 := &Request{
+		Resp:   redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait:   &sync.WaitGroup{},
+		Failed: failed,
+	}
+	assert.MustNoError(bc.PushBack(r1))
+	conn := <-recv
+
+	// the client goes away after the request was sent
+	failed.Set(true)
+	assert.MustNoError(conn.Writer.Encode(redis.NewBulkBytes(make([]byte, 1024)), true))
+	r1.Wait.Wait()
+	assert.Must(r1.Response.Resp == nil)
+	assert.Must(errors.Equal(r1.Response.Err, ErrFailedRequest))
+
+	// the discarded reply was drained, the next one pairs correctly
+	r2 := &Request{
+		Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait: &sync.WaitGroup{},
+	}
+	assert.MustNoError(bc.PushBack(r2))
+	conn = <-recv
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+	r2.Wait.Wait()
+	assert.MustNoError(r2.Response.Err)
+	assert.Must(string(r2.Response.Resp.Value) == "OK")
+}
+
+func TestBackendSocketLinger(t *testing.T) {
+	for _, config := range []*Config{
+		{}, {BackendSocketLinger: -1}, {BackendSocketLinger: 1}, {BackendSocketReset: true},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.MustNoError(err)
+		defer l.Close()
+
+		closed := make(chan error, 1)
+		go func() {
+			c, err := l.Accept()
+			assert.MustNoError(err)
+			defer c.Close()
+			conn := redis.NewConn(c)
+			if _, err := conn.Reader.Decode(); err != nil {
+				closed <- err
+				return
+			}
+			assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+			_, err = c.Read(make([]byte, 1))
+			closed <- err
+		}()
+
+		bc := NewBackendConn(l.Addr().String(), config)
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("PING"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		bc.Close()
+
+		err = <-closed
+		if config.BackendSocketReset {
+			assert.Must(err != nil && strings.Contains(err.Error(), "reset"))
+		} else {
+			assert.Must(err == io.EOF)
+		}
+	}
+}
+
+func TestBackendMaxQPS(t *testing.T) {
+	l := newMockBackend(t, replyOK)
+
+	bc := NewBackendConn(l.Addr().String(), &Config{BackendMaxQPS: 100})
+	defer bc.Close()
+
+	start := time.Now()
+	var reqs []*Request
+	for i := 0; i < 30; i++ {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		reqs = append(reqs, r)
+	}
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	// a burst of 10, then 20 more at 100 per second
+	assert.Must(time.Since(start) >= time.Millisecond*190)
+}
+
+func TestBackendCommandRewriter(t *testing.T) {
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		var args []string
+		for _, x := range req.Array {
+			args = append(args, string(x.Value))
+		}
+		return conn.Writer.Encode(redis.NewBulkBytes([]byte(strings.Join(args, " "))), true)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendBlockedCommands: []string{"FLUSHALL"},
+		BackendCommandRewriter: func(multi []*redis.Resp) []*redis.Resp {
+			switch string(multi[0].Value) {
+			case "GET":
+				multi[1] = redis.NewBulkBytes(append([]byte("ns:"), multi[1].Value...))
+				return multi
+			case "SETEX":
+				return []*redis.Resp{
+					redis.NewBulkBytes([]byte("SET")), multi[1], multi[3],
+					redis.NewBulkBytes([]byte("EX")), multi[2],
+				}
+			case "BOOM":
+				panic("boom")
+			case "NOOP":
+				return nil
+			}
+			return multi
+		},
+	})
+	defer bc.Close()
+
+	for cmd, expect := range map[string]string{
+		"GET k":        "GET ns:k",
+		"SETEX k 10 v": "SET k v EX 10",
+		"PING":         "PING",
+	} {
+		var multi []*redis.Resp
+		for _, s := range strings.Fields(cmd) {
+			multi = append(multi, redis.NewBulkBytes([]byte(s)))
+		}
+		r := &Request{Resp: redis.NewArray(multi), Wait: &sync.WaitGroup{}}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == expect)
+	}
+
+	for cmd, expect := range map[string]error{
+		"BOOM": ErrCommandRewrite, "NOOP": ErrCommandRewrite, "FLUSHALL": ErrCommandBlocked,
+	} {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte(cmd))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		assert.Must(errors.Equal(r.Response.Err, expect))
+	}
+}
+
+func TestBackendRequestTiming(t *testing.T) {
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		time.Sleep(time.Millisecond * 10)
+		return replyOK(conn, req)
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	r := &Request{
+		Resp:   redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+		Wait:   &sync.WaitGroup{},
+		Timing: &RequestTiming{},
+	}
+	assert.MustNoError(bc.PushBack(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+
+	tm := r.Timing
+	assert.Must(!tm.StartTime.IsZero() && !tm.SentTime.Before(tm.StartTime))
+	assert.Must(tm.RecvTime.Sub(tm.SentTime) >= time.Millisecond*10)
+}
+
+func TestBackendReconnect(t *testing.T) {
+	recv := make(chan *redis.Conn, 16)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- conn
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	newRequest := func() *Request {
+		return &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+	}
+
+	// the first request is left unanswered on the old connection
+	r1 := newRequest()
+	assert.MustNoError(bc.PushBack(r1))
+	conn1 := <-recv
+
+	bc.Reconnect()
+	r1.Wait.Wait()
+	assert.Must(errors.Equal(r1.Response.Err, ErrBackendReconnect))
+	assert.Must(!bc.Failed())
+
+	r2 := newRequest()
+	assert.MustNoError(bc.PushBack(r2))
+	conn2 := <-recv
+	assert.Must(conn2 != conn1)
+	assert.MustNoError(conn2.Writer.Encode(redis.NewString([]byte("OK")), true))
+	r2.Wait.Wait()
+	assert.MustNoError(r2.Response.Err)
+	assert.Must(string(r2.Response.Resp.Value) == "OK")
+}
+
+func TestBackendUnexpectedReplyBuffered(t *testing.T) {
+	recv := make(chan *redis.Conn, 16)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- conn
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{})
+	defer bc.Close()
+
+	newRequest := func() *Request {
+		return &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+	}
+
+	// a buggy backend answers twice in one write, so the extra reply is
+	// buffered along with the expected one
+	r1 := newRequest()
+	assert.MustNoError(bc.PushBack(r1))
+	conn := <-recv
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("1")), false))
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("2")), true))
+	r1.Wait.Wait()
+	assert.MustNoError(r1.Response.Err)
+	assert.Must(string(r1.Response.Resp.Value) == "1")
+
+	// the extra reply is never paired with a later request
+	for {
+		r := newRequest()
+		assert.MustNoError(bc.PushBack(r))
+		select {
+		case conn = <-recv:
+			assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+		case <-time.After(time.Millisecond * 100):
+		}
+		r.Wait.Wait()
+		if r.Response.Err == nil {
+			assert.Must(string(r.Response.Resp.Value) == "OK")
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestBackendUnexpectedReplyLate(t *testing.T) {
+	recv := make(chan *redis.Conn, 16)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- conn
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{BackendPushPollInterval: time.Millisecond * 10})
+	defer bc.Close()
+
+	newRequest := func() *Request {
+		return &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+	}
+
+	r1 := newRequest()
+	assert.MustNoError(bc.PushBack(r1))
+	conn := <-recv
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("1")), true))
+	r1.Wait.Wait()
+	assert.MustNoError(r1.Response.Err)
+	assert.Must(string(r1.Response.Resp.Value) == "1")
+
+	// a buggy backend answers again once r1 is done and the conn is idle
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("2")), true))
+	time.Sleep(time.Millisecond * 100)
+
+	// the poll reset the connection, the extra reply is never paired with
+	// a later request
+	for {
+		r := newRequest()
+		assert.MustNoError(bc.PushBack(r))
+		select {
+		case conn = <-recv:
+			assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+		case <-time.After(time.Millisecond * 100):
+		}
+		r.Wait.Wait()
+		if r.Response.Err == nil {
+			assert.Must(string(r.Response.Resp.Value) == "OK")
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestBackendNoFlush(t *testing.T) {
+	recv := make(chan *redis.Conn, 16)
+	l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		recv <- conn
+		return nil
+	})
+
+	bc := NewBackendConn(l.Addr().String(), &Config{BackendFlushMaxInterval: time.Millisecond * 200})
+	defer bc.Close()
+
+	newRequest := func(noflush bool) *Request {
+		return &Request{
+			Resp:    redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait:    &sync.WaitGroup{},
+			NoFlush: noflush,
+		}
+	}
+
+	// the hinted request waits for the one that follows
+	r1 := newRequest(true)
+	assert.MustNoError(bc.PushBack(r1))
+	time.Sleep(time.Millisecond * 50)
+	assert.Must(len(recv) == 0)
+	r2 := newRequest(false)
+	assert.MustNoError(bc.PushBack(r2))
+	for _, r := range []*Request{r1, r2} {
+		conn := <-recv
+		assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+
+	// a trailing hint is flushed anyway, after the max interval
+	start := time.Now()
+	r3 := newRequest(true)
+	assert.MustNoError(bc.PushBack(r3))
+	conn := <-recv
+	assert.Must(time.Since(start) >= time.Millisecond*150)
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+	r3.Wait.Wait()
+	assert.MustNoError(r3.Response.Err)
+}
+
+func TestBackendResolver(t *testing.T) {
+	// every backend answers with its own name
+	var addrs []string
+	for _, name := range []string{"b1", "b2"} {
+		resp := redis.NewString([]byte(name))
+		l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+			return conn.Writer.Encode(resp, true)
+		})
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	var rounds atomic2.Int64
+	resolver := func(addr string) (string, error) {
+		assert.Must(addr == "backend")
+		switch rounds.Incr() {
+		case 1:
+			return addrs[0], nil
+		case 2:
+			return "", errors.New("resolver is down")
+		default:
+			return addrs[1], nil
+		}
+	}
+	bc := NewBackendConn("backend", &Config{BackendResolver: resolver})
+	defer bc.Close()
+
+	get := func() *Request {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		return r
+	}
+
+	r := get()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "b1")
+
+	// the round after a failed resolution dials the new address
+	bc.Reconnect()
+	for {
+		r = get()
+		if r.Response.Err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(string(r.Response.Resp.Value) == "b2")
+	assert.Must(rounds.Get() == 3)
+}
+
+func TestBackendPushHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	accepted := make(chan *redis.Conn, 16)
+	recv := make(chan struct{}, 16)
+	closed := make(chan struct{}, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := redis.NewConn(c)
+			accepted <- conn
+			go func() {
+				defer func() { closed <- struct{}{} }()
+				defer c.Close()
+				for {
+					if _, err := conn.Reader.Decode(); err != nil {
+						return
+					}
+					recv <- struct{}{}
+				}
+			}()
+		}
+	}()
+
+	pushes := make(chan *redis.Resp, 16)
+	bc := NewBackendConn(l.Addr().String(), &Config{
+		BackendPushHandler:      func(push *redis.Resp) { pushes <- push },
+		BackendPushPollInterval: time.Millisecond * 10,
+	})
+	defer bc.Close()
+
+	newPush := func(msg string) *redis.Resp {
+		return &redis.Resp{Type: redis.TypePush, Array: []*redis.Resp{
+			redis.NewBulkBytes([]byte("message")), redis.NewBulkBytes([]byte(msg)),
+		}}
+	}
+	get := func() *Request {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		return r
+	}
+
+	r := get()
+	conn := <-accepted
+	<-recv
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+
+	// pushed while idle, surfaced without waiting for a request
+	assert.MustNoError(conn.Writer.Encode(newPush("idle"), true))
+	select {
+	case p := <-pushes:
+		assert.Must(p.IsPush() && string(p.Array[1].Value) == "idle")
+	case <-time.After(time.Second * 5):
+		assert.Must(false)
+	}
+
+	// pushed ahead of a reply, not taken for it
+	r = get()
+	<-recv
+	assert.MustNoError(conn.Writer.Encode(newPush("ahead"), false))
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "OK")
+	p := <-pushes
+	assert.Must(string(p.Array[1].Value) == "ahead")
+
+	// anything else arriving while idle resets the connection
+	assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		assert.Must(false)
+	}
+	assert.Must(!bc.Failed())
+	assert.Must(len(pushes) == 0)
+}
+
+func TestBackendRetryDropped(t *testing.T) {
+	// the backend accepts and drops every connection at once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var accepted atomic2.Int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Incr()
+			c.Close()
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), &Config{BackendRetryMinDelay: time.Millisecond * 50})
+	defer bc.Close()
+
+	deadline := time.Now().Add(time.Millisecond * 300)
+	for time.Now().Before(deadline) {
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		assert.MustNoError(bc.PushBack(r))
+		r.Wait.Wait()
+		assert.Must(r.Response.Err != nil)
+	}
+	// every round waits for the base delay, however fast the dial is
+	assert.Must(accepted.Get() <= 8)
+}
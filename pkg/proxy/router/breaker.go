@@ -0,0 +1,96 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+const breakerWindow = time.Second
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type CircuitBreaker struct {
+	mu sync.Mutex
+
+	FailRatio   float64
+	MinRequests int
+	Cooldown    time.Duration
+
+	state int
+	since time.Time
+	probe time.Time
+
+	total, fails int
+}
+
+func NewCircuitBreaker(ratio float64, min int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailRatio: ratio, MinRequests: min, Cooldown: cooldown,
+		since: time.Now(),
+	}
+}
+
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// Allow reports whether a request may be sent to the backend. Once the
+// cooldown of an open breaker has passed, a single probe request is let
+// through (half-open); its result decides whether the breaker closes.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.since) < b.Cooldown {
+			return false
+		}
+		b.state, b.probe = breakerHalfOpen, now
+		return true
+	case breakerHalfOpen:
+		if now.Sub(b.probe) < b.Cooldown {
+			return false
+		}
+		b.probe = now
+		return true
+	}
+	return true
+}
+
+// Record counts the result of a request. Results recorded while the
+// breaker is open are of requests sent before it tripped and are ignored,
+// only the probe let through once half-open may close it.
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		if now.Sub(b.since) > breakerWindow {
+			b.since, b.total, b.fails = now, 0, 0
+		}
+		b.total++
+		if failed {
+			b.fails++
+		}
+		if b.total >= b.MinRequests && float64(b.fails) >= b.FailRatio*float64(b.total) && b.fails != 0 {
+			b.state, b.since = breakerOpen, now
+		}
+	case breakerHalfOpen:
+		if failed {
+			b.state, b.since = breakerOpen, now
+		} else {
+			b.state, b.since, b.total, b.fails = breakerClosed, now, 0, 0
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(0.5, 4, time.Millisecond*50)
+	for i := 0; i < 3; i++ {
+		assert.Must(b.Allow())
+		b.Record(true)
+	}
+	assert.Must(!b.IsOpen())
+	b.Record(false)
+	assert.Must(b.IsOpen())
+	assert.Must(!b.Allow())
+
+	time.Sleep(time.Millisecond * 60)
+	assert.Must(b.Allow())
+	assert.Must(!b.Allow())
+	b.Record(true)
+	assert.Must(b.IsOpen())
+	assert.Must(!b.Allow())
+
+	time.Sleep(time.Millisecond * 60)
+	assert.Must(b.Allow())
+	b.Record(false)
+	assert.Must(!b.IsOpen())
+	assert.Must(b.Allow())
+}
+
+func TestCircuitBreakerLateSuccess(t *testing.T) {
+	b := NewCircuitBreaker(0.5, 2, time.Millisecond*50)
+	b.Record(true)
+	b.Record(true)
+	assert.Must(b.IsOpen())
+
+	// a request sent before the breaker tripped succeeds late
+	b.Record(false)
+	assert.Must(b.IsOpen())
+	assert.Must(!b.Allow())
+
+	time.Sleep(time.Millisecond * 60)
+	assert.Must(b.Allow())
+	b.Record(false)
+	assert.Must(!b.IsOpen())
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+const (
+	DefaultBackendRetryFailLimit = 10
+	DefaultBackendRetryMinDelay  = time.Millisecond * 50
+	DefaultBackendRetryMaxDelay  = time.Second * 5
+	DefaultBackendMaxInflight    = 4096
+
+	DefaultBackendFlushMaxBuffered = 64
+	DefaultBackendFlushMaxInterval = time.Microsecond * 300
+
+	DefaultBackendPushPollInterval = time.Millisecond * 100
+
+	DefaultBackendSendBufsize    = 1024 * 512
+	DefaultBackendDecoderBufsize = 1024 * 512
+)
+
+type Config struct {
+	Auth     string
+	AuthUser string
+
+	// BackendRetryFailLimit is how many failures in a row are retried after BackendRetryMinDelay.
+	BackendRetryFailLimit int
+	// BackendRetryMinDelay is the wait before a reconnect, doubled past BackendRetryFailLimit.
+	BackendRetryMinDelay time.Duration
+	// BackendRetryMaxDelay caps the wait before a reconnect.
+	BackendRetryMaxDelay time.Duration
+	// BackendRetryJitter randomizes each wait by up to that fraction, 0 to 1.
+	BackendRetryJitter float64
+	// BackendRetryMaxAttempts gives up on a backend after that many failures in a row, 0 never does.
+	BackendRetryMaxAttempts int
+
+	// BackendSlowlogThreshold logs requests answered slower than that, 0 disables.
+	BackendSlowlogThreshold time.Duration
+
+	// BackendBreakerFailRatio opens the circuit breaker above that ratio of failures, 0 disables.
+	BackendBreakerFailRatio float64
+	// BackendBreakerMinRequests is how many requests a second the breaker needs to judge.
+	BackendBreakerMinRequests int
+	// BackendBreakerCooldown is how long an open breaker waits before letting a probe through.
+	BackendBreakerCooldown time.Duration
+
+	// BackendWarmupCommands are sent after AUTH on each new backend conn, split like redis-cli.
+	BackendWarmupCommands []string
+
+	// BackendSourceAddr is the local address backend conns are bound to, empty lets the system choose.
+	BackendSourceAddr string
+
+	// BackendSocketLinger is passed to net.TCPConn.SetLinger on backend conns, 0 keeps the default.
+	BackendSocketLinger int
+	// BackendSocketReset resets backend conns on close, skipping TIME_WAIT, over BackendSocketLinger.
+	BackendSocketReset bool
+	// BackendDisableNoDelay turns TCP_NODELAY off, it is on by default.
+	BackendDisableNoDelay bool
+
+	// BackendBlockedCommands are refused with ErrCommandBlocked instead of being forwarded.
+	BackendBlockedCommands []string
+
+	// BackendCommandRewriter may change each command before it is sent, it must be concurrency safe.
+	BackendCommandRewriter func(multi []*redis.Resp) []*redis.Resp
+
+	// BackendResolver maps a backend address to the one dialed, on every connect.
+	BackendResolver func(addr string) (string, error)
+
+	// BackendPushHandler gets the RESP3 pushes of backends, on their reader goroutine.
+	BackendPushHandler func(push *redis.Resp)
+	// BackendPushPollInterval is how often idle backend conns are polled for pushes or stray replies.
+	BackendPushPollInterval time.Duration
+
+	// BackendMaxInflight bounds the requests sent to a backend conn and not answered yet.
+	BackendMaxInflight int
+
+	// BackendIdleTimeout disconnects a backend conn idle for that long, 0 disables.
+	BackendIdleTimeout time.Duration
+
+	// BackendFlushMaxBuffered is how many requests the writer buffers before a flush.
+	BackendFlushMaxBuffered int
+	// BackendFlushMaxInterval is how long a buffered request waits at most for a flush.
+	BackendFlushMaxInterval time.Duration
+
+	// BackendDecoderBufsize is the read buffer size of each backend conn.
+	BackendDecoderBufsize int
+
+	// BackendMaxQPS paces the requests of each backend conn, with short bursts, 0 disables.
+	BackendMaxQPS int
+
+	// BackendHooks are called along the way of each request, e.g. for tracing.
+	BackendHooks *BackendHooks
+}
+
+// BackendHooks are called along the way of each request through a backend
+// conn, e.g. to create tracing spans. They get the backend address and the
+// command name, never the request itself. They run on the hot path, from
+// several goroutines, so they must be safe for concurrent use and return
+// quickly. Nil hooks are skipped.
+type BackendHooks struct {
+	// OnEnqueue is called when the request is queued to the backend conn.
+	OnEnqueue func(addr, opstr string)
+	// OnEncode is called once the request is written to the connection's
+	// buffer, with the time it spent queued.
+	OnEncode func(addr, opstr string, queued time.Duration)
+	// OnReply is called when the reply has been decoded, or failed to,
+	// with the time since the request was encoded.
+	OnReply func(addr, opstr string, elapsed time.Duration, err error)
+}
+
+func (c *Config) retryMinDelay() time.Duration {
+	if c.BackendRetryMinDelay <= 0 {
+		return DefaultBackendRetryMinDelay
+	}
+	return c.BackendRetryMinDelay
+}
+
+func (c *Config) retryDelay() *DelayExp2 {
+	min, max := c.retryMinDelay(), c.BackendRetryMaxDelay
+	if max <= 0 {
+		max = DefaultBackendRetryMaxDelay
+	}
+	if max < min {
+		max = min
+	}
+	jitter := c.BackendRetryJitter
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	return &DelayExp2{
+		Min: int(min / time.Millisecond), Max: int(max / time.Millisecond),
+		Unit: time.Millisecond, Jitter: jitter,
+	}
+}
+
+func (c *Config) retryFailLimit() int {
+	if c.BackendRetryFailLimit <= 0 {
+		return DefaultBackendRetryFailLimit
+	}
+	return c.BackendRetryFailLimit
+}
+
+func (c *Config) maxInflight() int {
+	if c.BackendMaxInflight <= 0 {
+		return DefaultBackendMaxInflight
+	}
+	return c.BackendMaxInflight
+}
+
+// flushMaxBuffered never exceeds the in-flight limit, as the writer
+// flushes anyway once that many requests wait for replies.
+func (c *Config) flushMaxBuffered() int {
+	n := c.BackendFlushMaxBuffered
+	if n <= 0 {
+		n = DefaultBackendFlushMaxBuffered
+	}
+	if max := c.maxInflight(); n > max {
+		n = max
+	}
+	return n
+}
+
+func (c *Config) pushPollInterval() time.Duration {
+	if c.BackendPushPollInterval <= 0 {
+		return DefaultBackendPushPollInterval
+	}
+	return c.BackendPushPollInterval
+}
+
+func (c *Config) flushMaxInterval() time.Duration {
+	if c.BackendFlushMaxInterval <= 0 {
+		return DefaultBackendFlushMaxInterval
+	}
+	return c.BackendFlushMaxInterval
+}
+
+func (c *Config) decoderBufsize() int {
+	if c.BackendDecoderBufsize <= 0 {
+		return DefaultBackendDecoderBufsize
+	}
+	return c.BackendDecoderBufsize
+}
+
+func (c *Config) blockedCommands() map[string]bool {
+	if len(c.BackendBlockedCommands) == 0 {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, cmd := range c.BackendBlockedCommands {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			m[strings.ToUpper(cmd)] = true
+		}
+	}
+	return m
+}
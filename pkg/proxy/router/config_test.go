@@ -0,0 +1,29 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestConfigFlushPolicy(t *testing.T) {
+	c := &Config{}
+	assert.Must(c.flushMaxBuffered() == DefaultBackendFlushMaxBuffered)
+	assert.Must(c.flushMaxInterval() == DefaultBackendFlushMaxInterval)
+
+	c = &Config{BackendFlushMaxBuffered: 16, BackendFlushMaxInterval: time.Millisecond}
+	assert.Must(c.flushMaxBuffered() == 16)
+	assert.Must(c.flushMaxInterval() == time.Millisecond)
+
+	c = &Config{BackendFlushMaxBuffered: 128, BackendMaxInflight: 32}
+	assert.Must(c.flushMaxBuffered() == 32)
+}
+
+func TestConfigDecoderBufsize(t *testing.T) {
+	assert.Must((&Config{}).decoderBufsize() == DefaultBackendDecoderBufsize)
+	assert.Must((&Config{BackendDecoderBufsize: 4096}).decoderBufsize() == 4096)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"math/rand"
+	"time"
+)
+
+type DelayExp2 struct {
+	Min, Max int
+	Value    int
+	Unit     time.Duration
+
+	// Jitter randomizes each delay within [1-Jitter, 1+Jitter] of the
+	// computed value, 0 disables it.
+	Jitter float64
+}
+
+func (d *DelayExp2) Reset() {
+	d.Value = 0
+}
+
+func (d *DelayExp2) NextValue() int {
+	v := d.Value * 2
+	if v < d.Min {
+		v = d.Min
+	}
+	if v > d.Max {
+		v = d.Max
+	}
+	d.Value = v
+	return v
+}
+
+func (d *DelayExp2) NextDelay() time.Duration {
+	delay := d.Unit * time.Duration(d.NextValue())
+	if d.Jitter > 0 {
+		delta := float64(delay) * d.Jitter * (rand.Float64()*2 - 1)
+		delay += time.Duration(delta)
+	}
+	return delay
+}
+
+func (d *DelayExp2) After() <-chan time.Time {
+	return time.After(d.NextDelay())
+}
+
+func (d *DelayExp2) Sleep() {
+	time.Sleep(d.NextDelay())
+}
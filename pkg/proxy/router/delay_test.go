@@ -0,0 +1,33 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestDelayExp2(t *testing.T) {
+	d := &DelayExp2{Min: 50, Max: 300, Unit: time.Millisecond}
+	for _, v := range []int{50, 100, 200, 300, 300} {
+		assert.Must(d.NextValue() == v)
+	}
+	d.Reset()
+	assert.Must(d.NextValue() == 50)
+}
+
+func TestDelayExp2Jitter(t *testing.T) {
+	d := &DelayExp2{Min: 100, Max: 100, Unit: time.Millisecond, Jitter: 0.5}
+	var m = make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		v := d.NextDelay()
+		assert.Must(v >= time.Millisecond*50 && v <= time.Millisecond*150)
+		m[v] = true
+	}
+	assert.Must(len(m) > 1)
+	d.Reset()
+	assert.Must(d.Value == 0)
+}
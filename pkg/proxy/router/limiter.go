@@ -0,0 +1,42 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "time"
+
+// RateLimiter is a token bucket allowing QPS requests per second, with
+// bursts of up to a tenth of a second's worth. It is not safe for
+// concurrent use, each backend conn's writer owns its own.
+type RateLimiter struct {
+	QPS   float64
+	Burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(qps int) *RateLimiter {
+	burst := float64(qps) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{QPS: float64(qps), Burst: burst, tokens: burst}
+}
+
+// Reserve takes a token at time now and returns how long to wait before
+// using it, 0 while the rate is not exceeded.
+func (l *RateLimiter) Reserve(now time.Time) time.Duration {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.QPS
+		if l.tokens > l.Burst {
+			l.tokens = l.Burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.QPS * float64(time.Second))
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(100)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.Must(l.Reserve(now) == 0)
+	}
+	assert.Must(l.Reserve(now) == time.Millisecond*10)
+	assert.Must(l.Reserve(now) == time.Millisecond*20)
+
+	// tokens refill at the given rate, up to the burst
+	now = now.Add(time.Millisecond * 30)
+	assert.Must(l.Reserve(now) == 0)
+	now = now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		assert.Must(l.Reserve(now) == 0)
+	}
+	assert.Must(l.Reserve(now) != 0)
+
+	l = NewRateLimiter(5)
+	assert.Must(l.Burst == 1)
+	assert.Must(l.Reserve(now) == 0)
+	assert.Must(l.Reserve(now) == time.Millisecond*200)
+}
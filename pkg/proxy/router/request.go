@@ -4,10 +4,14 @@
 package router
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 )
 
 type Dispatcher interface {
@@ -29,5 +33,140 @@ type Request struct {
 	Wait *sync.WaitGroup
 	slot *sync.WaitGroup
 
+	// Failed is shared by the requests of a session and set once one of
+	// them fails or the client is gone. Requests not sent yet are then
+	// dropped, and replies to the ones already sent are decoded, as the
+	// bytes on the wire can't be taken back, but discarded.
 	Failed *atomic2.Bool
+
+	// Deadline bounds how long the backend may take to answer, zero
+	// means the connection-wide read timeout applies. Once it passes the
+	// backend connection is closed, as the late reply can't be told from
+	// the next one, so every other request pipelined on it fails too and
+	// the sessions they belong to are closed.
+	Deadline time.Time
+
+	// Timing, if set, is filled in as the request goes through the
+	// backend conn, nothing is recorded otherwise.
+	Timing *RequestTiming
+
+	// NoFlush hints that more requests to the same backend follow at once,
+	// so this one is buffered instead of written out even when it is the
+	// last one queued. Buffered requests are flushed anyway once
+	// BackendFlushMaxBuffered of them are pending, or when no request
+	// follows within BackendFlushMaxInterval.
+	NoFlush bool
+
+	sent   int64
+	queued int64
+
+	keepalive bool
+}
+
+// RequestTiming tells when a request was queued to a backend conn, when
+// it was written to the connection's buffer and when its reply was read,
+// so queue wait, network and total times can be derived. Times stay zero
+// for the steps the request didn't get to.
+type RequestTiming struct {
+	StartTime time.Time
+	SentTime  time.Time
+	RecvTime  time.Time
+}
+
+func (r *Request) opstr() string {
+	if r.OpStr != "" {
+		return r.OpStr
+	}
+	if r.Resp != nil && len(r.Resp.Array) != 0 {
+		return string(r.Resp.Array[0].Value)
+	}
+	return ""
+}
+
+var (
+	ErrBadMultiKeyResp = errors.New("bad multi-key command, no keys given")
+	ErrCommandNotSplit = errors.New("command can't be split by key")
+)
+
+// dispatchSplit splits r, a MGET or a DEL, into a sub-request of the same
+// command per key, sharing r.Wait and r.Failed, and dispatches each of
+// them through d, which routes it by slot. It doesn't wait for them.
+func dispatchSplit(r *Request, d Dispatcher) ([]*Request, error) {
+	switch r.OpStr {
+	case "MGET", "DEL":
+	default:
+		return nil, errors.Trace(ErrCommandNotSplit)
+	}
+	if len(r.Resp.Array) < 2 {
+		return nil, errors.Trace(ErrBadMultiKeyResp)
+	}
+	var sub = make([]*Request, len(r.Resp.Array)-1)
+	for i := range sub {
+		sub[i] = &Request{
+			OpStr: r.OpStr,
+			Start: r.Start,
+			Resp: redis.NewArray([]*redis.Resp{
+				r.Resp.Array[0],
+				r.Resp.Array[i+1],
+			}),
+			Wait:   r.Wait,
+			Failed: r.Failed,
+		}
+		if err := d.Dispatch(sub[i]); err != nil {
+			return sub[:i], err
+		}
+	}
+	return sub, nil
+}
+
+// splitReplies checks the replies to the sub-requests of a split command
+// and returns one per key: the value for MGET, out of the single element
+// array each sub-request is answered with, and the count for DEL.
+func splitReplies(op string, sub []*Request) ([]*redis.Resp, error) {
+	var array = make([]*redis.Resp, len(sub))
+	for i, x := range sub {
+		if err := x.Response.Err; err != nil {
+			return nil, err
+		}
+		resp := x.Response.Resp
+		if resp == nil {
+			return nil, ErrRespIsRequired
+		}
+		switch op {
+		case "MGET":
+			if !resp.IsArray() || len(resp.Array) != 1 {
+				return nil, errors.New(fmt.Sprintf("bad mget resp: %s array.len = %d", resp.Type, len(resp.Array)))
+			}
+			array[i] = resp.Array[0]
+		default:
+			if !resp.IsInt() || len(resp.Value) != 1 {
+				return nil, errors.New(fmt.Sprintf("bad mdel resp: %s", resp))
+			}
+			array[i] = resp
+		}
+	}
+	return array, nil
+}
+
+// SplitAndDispatch splits a MGET or a DEL into one such command per key,
+// sends them through d, e.g. a Router, so each one goes to the backend of
+// its slot, and once all of them are answered returns a reply per key in
+// key order, as the session does, or the first error that any of them
+// failed with. Other commands are rejected with ErrCommandNotSplit.
+func SplitAndDispatch(multi []*redis.Resp, d Dispatcher) ([]*redis.Resp, error) {
+	if len(multi) == 0 {
+		return nil, errors.Trace(ErrBadMultiKeyResp)
+	}
+	r := &Request{
+		OpStr: strings.ToUpper(string(multi[0].Value)),
+		Start: microseconds(),
+		Resp:  redis.NewArray(multi),
+		Wait:  &sync.WaitGroup{}, Failed: &atomic2.Bool{},
+	}
+	sub, err := dispatchSplit(r, d)
+	r.Wait.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return splitReplies(r.OpStr, sub)
 }
@@ -0,0 +1,78 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+func TestSplitAndDispatch(t *testing.T) {
+	router := NewWithConfig(&Config{})
+	defer router.Close()
+
+	// every backend answers MGET with its name and the key, and DEL with
+	// the number of the backend
+	for i, name := range []string{"a", "b"} {
+		i, name := i, name
+		l := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+			var resp *redis.Resp
+			switch string(req.Array[0].Value) {
+			case "mget":
+				value := name + " " + string(req.Array[1].Value)
+				resp = redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte(value))})
+			default:
+				resp = redis.NewInt([]byte(strconv.Itoa(i)))
+			}
+			return conn.Writer.Encode(resp, true)
+		})
+
+		for slot := i * MaxSlotNum / 2; slot < (i+1)*MaxSlotNum/2; slot++ {
+			assert.MustNoError(router.FillSlot(slot, l.Addr().String(), "", false))
+		}
+	}
+	backend := func(key string) string {
+		if hashSlot([]byte(key)) < MaxSlotNum/2 {
+			return "a"
+		}
+		return "b"
+	}
+
+	keys := []string{"k0", "a", "k1", "b", "c", "k2"}
+	var used = make(map[string]bool)
+	for _, key := range keys {
+		used[backend(key)] = true
+	}
+	assert.Must(len(used) == 2)
+	split := func(op string) []*redis.Resp {
+		multi := []*redis.Resp{redis.NewBulkBytes([]byte(op))}
+		for _, key := range keys {
+			multi = append(multi, redis.NewBulkBytes([]byte(key)))
+		}
+		array, err := SplitAndDispatch(multi, router)
+		assert.MustNoError(err)
+		assert.Must(len(array) == len(keys))
+		return array
+	}
+	for i, resp := range split("mget") {
+		assert.Must(string(resp.Value) == backend(keys[i])+" "+keys[i])
+	}
+	for i, resp := range split("DEL") {
+		assert.Must(resp.IsInt() && string(resp.Value) == map[string]string{"a": "0", "b": "1"}[backend(keys[i])])
+	}
+
+	_, err := SplitAndDispatch([]*redis.Resp{redis.NewBulkBytes([]byte("MGET"))}, router)
+	assert.Must(errors.Equal(err, ErrBadMultiKeyResp))
+
+	multi := []*redis.Resp{
+		redis.NewBulkBytes([]byte("MSET")),
+		redis.NewBulkBytes([]byte("k0")), redis.NewBulkBytes([]byte("v0")),
+	}
+	_, err = SplitAndDispatch(multi, router)
+	assert.Must(errors.Equal(err, ErrCommandNotSplit))
+}
@@ -4,10 +4,12 @@
 package router
 
 import (
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
@@ -17,8 +19,8 @@ const MaxSlotNum = models.DEFAULT_SLOT_NUM
 type Router struct {
 	mu sync.Mutex
 
-	auth string
-	pool map[string]*SharedBackendConn
+	config *Config
+	pool   map[string]*SharedBackendConn
 
 	slots [MaxSlotNum]*Slot
 
@@ -30,9 +32,13 @@ func New() *Router {
 }
 
 func NewWithAuth(auth string) *Router {
+	return NewWithConfig(&Config{Auth: auth})
+}
+
+func NewWithConfig(config *Config) *Router {
 	s := &Router{
-		auth: auth,
-		pool: make(map[string]*SharedBackendConn),
+		config: config,
+		pool:   make(map[string]*SharedBackendConn),
 	}
 	for i := 0; i < len(s.slots); i++ {
 		s.slots[i] = &Slot{id: i}
@@ -87,6 +93,78 @@ func (s *Router) KeepAlive() error {
 	return nil
 }
 
+var ErrBackendNotFound = errors.New("backend conn not found")
+
+// Reconnect makes the pooled backend conn to addr drop its connection and
+// dial a new one, see BackendConn.Reconnect.
+func (s *Router) Reconnect(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	bc := s.pool[addr]
+	if bc == nil {
+		return errors.Trace(ErrBackendNotFound)
+	}
+	bc.Reconnect()
+	return nil
+}
+
+// BackendStats returns connection establishment stats of each backend.
+func (s *Router) BackendStats() map[string]*BackendStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]*BackendStats, len(s.pool))
+	for addr, bc := range s.pool {
+		m[addr] = bc.Stats()
+	}
+	return m
+}
+
+// PoolEntry describes a pooled backend conn at the time of a snapshot.
+type PoolEntry struct {
+	Addr      string `json:"addr"`
+	Refcnt    int    `json:"refcnt"`
+	Closed    bool   `json:"closed"`
+	Failed    bool   `json:"failed"`
+	Connected bool   `json:"connected"`
+	ReadOnly  bool   `json:"readonly"`
+	Queued    int    `json:"queued"`
+	Inflight  int64  `json:"inflight"`
+}
+
+// PoolSnapshot returns a copy of the state of every pooled backend conn,
+// sorted by address. It is safe to call while the router is in use.
+func (s *Router) PoolSnapshot() []PoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]PoolEntry, 0, len(s.pool))
+	for addr, bc := range s.pool {
+		bc.mu.Lock()
+		refcnt := bc.refcnt
+		bc.mu.Unlock()
+		entries = append(entries, PoolEntry{
+			Addr:      addr,
+			Refcnt:    refcnt,
+			Closed:    bc.closed.Get(),
+			Failed:    bc.Failed(),
+			Connected: bc.connected(),
+			ReadOnly:  bc.ReadOnly(),
+			Queued:    len(bc.input),
+			Inflight:  bc.inflight.Get(),
+		})
+	}
+	sort.Sort(poolEntries(entries))
+	return entries
+}
+
+type poolEntries []PoolEntry
+
+func (p poolEntries) Len() int           { return len(p) }
+func (p poolEntries) Less(i, j int) bool { return p[i].Addr < p[j].Addr }
+func (p poolEntries) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 func (s *Router) Dispatch(r *Request) error {
 	hkey := getHashKey(r.Resp, r.OpStr)
 	slot := s.slots[hashSlot(hkey)]
@@ -98,7 +176,7 @@ func (s *Router) getBackendConn(addr string) *SharedBackendConn {
 	if bc != nil {
 		bc.IncrRefcnt()
 	} else {
-		bc = NewSharedBackendConn(addr, s.auth)
+		bc = NewSharedBackendConn(addr, s.config)
 		s.pool[addr] = bc
 	}
 	return bc
@@ -140,12 +218,15 @@ func (s *Router) fillSlot(i int, addr, from string, lock bool) {
 	slot.reset()
 
 	if len(addr) != 0 {
-		xx := strings.Split(addr, ":")
-		if len(xx) >= 1 {
-			slot.backend.host = []byte(xx[0])
-		}
-		if len(xx) >= 2 {
-			slot.backend.port = []byte(xx[1])
+		// unix sockets have no host:port, and can't be a migration target
+		if network, _ := redis.SplitNetworkAddr(addr); network == "tcp" {
+			xx := strings.Split(addr, ":")
+			if len(xx) >= 1 {
+				slot.backend.host = []byte(xx[0])
+			}
+			if len(xx) >= 2 {
+				slot.backend.port = []byte(xx[1])
+			}
 		}
 		slot.backend.addr = addr
 		slot.backend.bc = s.getBackendConn(addr)
@@ -0,0 +1,41 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+func TestPoolSnapshot(t *testing.T) {
+	s := NewWithConfig(&Config{})
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:6380", "", false))
+	assert.MustNoError(s.FillSlot(1, "127.0.0.1:6380", "", false))
+	assert.MustNoError(s.FillSlot(2, "127.0.0.1:6379", "127.0.0.1:6380", false))
+
+	entries := s.PoolSnapshot()
+	assert.Must(len(entries) == 2)
+	assert.Must(entries[0].Addr == "127.0.0.1:6379" && entries[0].Refcnt == 1)
+	assert.Must(entries[1].Addr == "127.0.0.1:6380" && entries[1].Refcnt == 3)
+	for _, e := range entries {
+		assert.Must(!e.Closed && !e.Connected && e.Queued == 0 && e.Inflight == 0)
+	}
+
+	assert.MustNoError(s.ResetSlot(2))
+	entries = s.PoolSnapshot()
+	assert.Must(len(entries) == 1 && entries[0].Refcnt == 2)
+}
+
+func TestRouterReconnect(t *testing.T) {
+	s := NewWithConfig(&Config{})
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:6380", "", false))
+	assert.MustNoError(s.Reconnect("127.0.0.1:6380"))
+	assert.Must(errors.Equal(s.Reconnect("127.0.0.1:6379"), ErrBackendNotFound))
+	assert.MustNoError(s.Close())
+	assert.Must(s.Reconnect("127.0.0.1:6380") == errClosedRouter)
+}
@@ -75,23 +75,43 @@ func (s *Session) Serve(d Dispatcher, maxPipeline int) {
 	}()
 
 	tasks := make(chan *Request, maxPipeline)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer func() {
 			for _ = range tasks {
 			}
 		}()
 		if err := s.loopWriter(tasks); err != nil {
+			s.failed.Set(true)
 			errlist.PushBack(err)
 		}
 		s.Close()
 	}()
 
-	defer close(tasks)
+	defer func() {
+		close(tasks)
+		// replies to the requests already read are still due, e.g. to a
+		// client that half-closed after a pipeline
+		<-done
+	}()
 	if err := s.loopReader(tasks, d); err != nil {
+		// the client is gone, don't bother with its pending requests;
+		// after EOF or a rejected request it may still read the replies
+		if isBrokenConn(err) {
+			s.failed.Set(true)
+		}
 		errlist.PushBack(err)
 	}
 }
 
+// isBrokenConn tells whether err is an i/o failure of the connection
+// itself, rather than EOF, a timeout or a bad request.
+func isBrokenConn(err error) bool {
+	e, ok := errors.Cause(err).(*net.OpError)
+	return ok && !e.Timeout()
+}
+
 func (s *Session) loopReader(tasks chan<- *Request, d Dispatcher) error {
 	if d == nil {
 		return errors.New("nil dispatcher")
@@ -135,12 +155,15 @@ func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
 	r.Wait.Wait()
 	if r.Coalesce != nil {
 		if err := r.Coalesce(); err != nil {
-			return nil, err
+			r.Response.Err = err
 		}
 	}
 	resp, err := r.Response.Resp, r.Response.Err
 	if err != nil {
-		return nil, err
+		if !isRefused(err) {
+			return nil, err
+		}
+		resp = redis.NewError([]byte("ERR " + errors.Cause(err).Error()))
 	}
 	if resp == nil {
 		return nil, ErrRespIsRequired
@@ -257,36 +280,14 @@ func (s *Session) handleRequestMGet(r *Request, d Dispatcher) (*Request, error)
 	if nkeys <= 1 {
 		return r, d.Dispatch(r)
 	}
-	var sub = make([]*Request, nkeys)
-	for i := 0; i < len(sub); i++ {
-		sub[i] = &Request{
-			OpStr: r.OpStr,
-			Start: r.Start,
-			Resp: redis.NewArray([]*redis.Resp{
-				r.Resp.Array[0],
-				r.Resp.Array[i+1],
-			}),
-			Wait:   r.Wait,
-			Failed: r.Failed,
-		}
-		if err := d.Dispatch(sub[i]); err != nil {
-			return nil, err
-		}
+	sub, err := dispatchSplit(r, d)
+	if err != nil {
+		return nil, err
 	}
 	r.Coalesce = func() error {
-		var array = make([]*redis.Resp, len(sub))
-		for i, x := range sub {
-			if err := x.Response.Err; err != nil {
-				return err
-			}
-			resp := x.Response.Resp
-			if resp == nil {
-				return ErrRespIsRequired
-			}
-			if !resp.IsArray() || len(resp.Array) != 1 {
-				return errors.New(fmt.Sprintf("bad mget resp: %s array.len = %d", resp.Type, len(resp.Array)))
-			}
-			array[i] = resp.Array[0]
+		array, err := splitReplies(r.OpStr, sub)
+		if err != nil {
+			return err
 		}
 		r.Response.Resp = redis.NewArray(array)
 		return nil
@@ -330,7 +331,7 @@ func (s *Session) handleRequestMSet(r *Request, d Dispatcher) (*Request, error)
 				return ErrRespIsRequired
 			}
 			if !resp.IsString() {
-				return errors.New(fmt.Sprintf("bad mset resp: %s value.len = %d", resp.Type, len(resp.Value)))
+				return errors.New(fmt.Sprintf("bad mset resp: %s", resp))
 			}
 			r.Response.Resp = resp
 		}
@@ -344,40 +345,22 @@ func (s *Session) handleRequestMDel(r *Request, d Dispatcher) (*Request, error)
 	if nkeys <= 1 {
 		return r, d.Dispatch(r)
 	}
-	var sub = make([]*Request, nkeys)
-	for i := 0; i < len(sub); i++ {
-		sub[i] = &Request{
-			OpStr: r.OpStr,
-			Start: r.Start,
-			Resp: redis.NewArray([]*redis.Resp{
-				r.Resp.Array[0],
-				r.Resp.Array[i+1],
-			}),
-			Wait:   r.Wait,
-			Failed: r.Failed,
-		}
-		if err := d.Dispatch(sub[i]); err != nil {
-			return nil, err
-		}
+	sub, err := dispatchSplit(r, d)
+	if err != nil {
+		return nil, err
 	}
 	r.Coalesce = func() error {
+		array, err := splitReplies(r.OpStr, sub)
+		if err != nil {
+			return err
+		}
 		var n int
-		for _, x := range sub {
-			if err := x.Response.Err; err != nil {
-				return err
-			}
-			resp := x.Response.Resp
-			if resp == nil {
-				return ErrRespIsRequired
-			}
-			if !resp.IsInt() || len(resp.Value) != 1 {
-				return errors.New(fmt.Sprintf("bad mdel resp: %s value.len = %d", resp.Type, len(resp.Value)))
-			}
+		for _, resp := range array {
 			if resp.Value[0] != '0' {
 				n++
 			}
 		}
-		r.Response.Resp = redis.NewInt([]byte(strconv.Itoa(n)))
+		r.Response.Resp = redis.NewInteger(int64(n))
 		return nil
 	}
 	return r, nil
@@ -0,0 +1,111 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestSessionHalfClose(t *testing.T) {
+	backend := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		// answer after the client is done sending
+		time.Sleep(time.Millisecond * 10)
+		return replyOK(conn, req)
+	})
+
+	router := NewWithConfig(&Config{})
+	defer router.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(router.FillSlot(i, backend.Addr().String(), "", false))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		NewSession(c, "").Serve(router, 64)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.MustNoError(err)
+	defer c.Close()
+	conn := redis.NewConn(c)
+
+	const n = 16
+	for i := 0; i < n; i++ {
+		multi := [][]byte{[]byte("GET"), []byte("key")}
+		assert.MustNoError(conn.Writer.EncodeMultiBulk(multi, i == n-1))
+	}
+	assert.MustNoError(c.(*net.TCPConn).CloseWrite())
+
+	for i := 0; i < n; i++ {
+		resp, err := conn.Reader.Decode()
+		assert.MustNoError(err)
+		assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	}
+}
+
+func TestSessionMGet(t *testing.T) {
+	// the backend holds every key as its own value
+	backend := newMockBackend(t, func(conn *redis.Conn, req *redis.Resp) error {
+		// split per key, as it was sent by the client
+		assert.Must(string(req.Array[0].Value) == "MGET" && len(req.Array) == 2)
+		resp := redis.NewArray([]*redis.Resp{redis.NewBulkBytes(req.Array[1].Value)})
+		return conn.Writer.Encode(resp, true)
+	})
+
+	router := NewWithConfig(&Config{})
+	defer router.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(router.FillSlot(i, backend.Addr().String(), "", false))
+	}
+
+	c, sc := net.Pipe()
+	defer c.Close()
+	go NewSession(sc, "").Serve(router, 64)
+	conn := redis.NewConn(c)
+
+	multi := [][]byte{[]byte("MGET"), []byte("a"), []byte("c"), []byte("b")}
+	assert.MustNoError(conn.Writer.EncodeMultiBulk(multi, true))
+	resp, err := conn.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.String() == `*3 ["a" "c" "b"]`)
+}
+
+func TestSessionBlockedCommand(t *testing.T) {
+	backend := newMockBackend(t, replyOK)
+
+	router := NewWithConfig(&Config{BackendBlockedCommands: []string{"EXPIRE"}})
+	defer router.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(router.FillSlot(i, backend.Addr().String(), "", false))
+	}
+
+	c, sc := net.Pipe()
+	defer c.Close()
+	go NewSession(sc, "").Serve(router, 64)
+	conn := redis.NewConn(c)
+
+	// the client gets an error reply and may go on
+	for _, op := range []string{"EXPIRE", "SET", "EXPIRE", "GET"} {
+		multi := [][]byte{[]byte(op), []byte("key")}
+		assert.MustNoError(conn.Writer.EncodeMultiBulk(multi, true))
+		resp, err := conn.Reader.Decode()
+		assert.MustNoError(err)
+		if op == "EXPIRE" {
+			assert.Must(resp.IsError() && string(resp.Value) == "ERR command is blocked by proxy")
+		} else {
+			assert.Must(resp.IsString() && string(resp.Value) == "OK")
+		}
+	}
+}
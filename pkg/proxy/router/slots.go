@@ -64,10 +64,13 @@ func (s *Slot) forward(r *Request, key []byte) error {
 	s.lock.RUnlock()
 	if err != nil {
 		return err
-	} else {
-		bc.PushBack(r)
-		return nil
 	}
+	if err := bc.PushBack(r); err != nil {
+		r.slot.Done()
+		r.slot = nil
+		return err
+	}
+	return nil
 }
 
 var ErrSlotIsNotReady = errors.New("slot is not ready, may be offline")
@@ -102,7 +105,9 @@ func (s *Slot) slotsmgrt(r *Request, key []byte) error {
 		}),
 		Wait: &sync.WaitGroup{},
 	}
-	s.migrate.bc.PushBack(m)
+	if err := s.migrate.bc.PushBack(m); err != nil {
+		return err
+	}
 
 	m.Wait.Wait()
 
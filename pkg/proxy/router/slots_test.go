@@ -2,3 +2,24 @@
 // Licensed under the MIT (MIT-LICENSE.txt) license.
 
 package router
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestFillSlotAddr(t *testing.T) {
+	s := NewWithConfig(&Config{})
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:6379", "", false))
+	slot := s.slots[0]
+	assert.Must(string(slot.backend.host) == "127.0.0.1")
+	assert.Must(string(slot.backend.port) == "6379")
+
+	assert.MustNoError(s.FillSlot(0, "unix:///tmp/redis.sock", "", false))
+	assert.Must(slot.backend.addr == "unix:///tmp/redis.sock")
+	assert.Must(slot.backend.host == nil && slot.backend.port == nil)
+	assert.Must(slot.backend.bc != nil)
+}
@@ -6,6 +6,7 @@ package router
 import (
 	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/atomic2"
 )
@@ -95,3 +96,66 @@ func incrOpStats(opstr string, usecs int64) {
 	s.usecs.Add(usecs)
 	cmdstats.requests.Incr()
 }
+
+var phaseBuckets = []time.Duration{
+	time.Millisecond, time.Millisecond * 10, time.Millisecond * 100, time.Second,
+}
+
+// PhaseStats records one phase of establishing a backend connection: the
+// number of attempts and failures, the total time spent, and a coarse
+// histogram of durations (<1ms, <10ms, <100ms, <1s, >=1s).
+type PhaseStats struct {
+	calls atomic2.Int64
+	fails atomic2.Int64
+	usecs atomic2.Int64
+
+	buckets [5]atomic2.Int64
+}
+
+func (s *PhaseStats) Calls() int64 {
+	return s.calls.Get()
+}
+
+func (s *PhaseStats) Fails() int64 {
+	return s.fails.Get()
+}
+
+func (s *PhaseStats) USecs() int64 {
+	return s.usecs.Get()
+}
+
+func (s *PhaseStats) Buckets() []int64 {
+	var b = make([]int64, len(s.buckets))
+	for i := range s.buckets {
+		b[i] = s.buckets[i].Get()
+	}
+	return b
+}
+
+func (s *PhaseStats) record(d time.Duration, err error) {
+	s.calls.Incr()
+	if err != nil {
+		s.fails.Incr()
+	}
+	s.usecs.Add(int64(d / time.Microsecond))
+	i := 0
+	for i < len(phaseBuckets) && d >= phaseBuckets[i] {
+		i++
+	}
+	s.buckets[i].Incr()
+}
+
+func (s *PhaseStats) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["calls"] = s.Calls()
+	m["fails"] = s.Fails()
+	m["usecs"] = s.USecs()
+	m["buckets"] = s.Buckets()
+	return json.Marshal(m)
+}
+
+type BackendStats struct {
+	Dial   PhaseStats `json:"dial"`
+	Auth   PhaseStats `json:"auth"`
+	Warmup PhaseStats `json:"warmup"`
+}
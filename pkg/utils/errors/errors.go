@@ -21,6 +21,14 @@ func (e *TracedError) Error() string {
 	return e.Cause.Error()
 }
 
+func (e *TracedError) Unwrap() error {
+	return e.Cause
+}
+
+type causer interface {
+	Cause() error
+}
+
 func New(s string) error {
 	return errors.New(s)
 }
@@ -63,10 +71,12 @@ func Stack(err error) trace.Stack {
 
 func Cause(err error) error {
 	for err != nil {
-		e, ok := err.(*TracedError)
-		if ok {
+		switch e := err.(type) {
+		case *TracedError:
 			err = e.Cause
-		} else {
+		case causer:
+			err = e.Cause()
+		default:
 			return err
 		}
 	}